@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxAllocMB bounds POST /debug/alloc so the demo can't OOM the host.
+	maxAllocMB = 256
+	// maxAllocHold bounds how long the allocation is kept live.
+	maxAllocHold = 10 * time.Second
+)
+
+// allocBusy admits one /debug/alloc at a time, so concurrent calls can't add
+// up past maxAllocMB.
+var allocBusy atomic.Bool
+
+// heapSnapshot is the subset of runtime.MemStats /debug/alloc reports.
+type heapSnapshot struct {
+	HeapAllocMB    float64 `json:"heap_alloc_mb"`
+	HeapSysMB      float64 `json:"heap_sys_mb"`
+	HeapReleasedMB float64 `json:"heap_released_mb"`
+	NumGC          uint32  `json:"num_gc"`
+}
+
+func readHeap() heapSnapshot {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	const mb = 1 << 20
+	return heapSnapshot{
+		HeapAllocMB:    float64(ms.HeapAlloc) / mb,
+		HeapSysMB:      float64(ms.HeapSys) / mb,
+		HeapReleasedMB: float64(ms.HeapReleased) / mb,
+		NumGC:          ms.NumGC,
+	}
+}
+
+// allocHandler allocates ?mb= megabytes (default 10, at most maxAllocMB),
+// touches every page so it is really resident, holds it for ?hold= (default
+// 1s), then drops it and forces a GC, reporting the heap at each step. It is
+// for memory and GC demos.
+func allocHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mb := 10
+	if v := q.Get("mb"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAllocMB {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "mb must be an integer from 1 to " + strconv.Itoa(maxAllocMB)})
+			return
+		}
+		mb = n
+	}
+	hold := time.Second
+	if v := q.Get("hold"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxAllocHold {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "hold must be a duration from 0 to " + maxAllocHold.String()})
+			return
+		}
+		hold = d
+	}
+	if !allocBusy.CompareAndSwap(false, true) {
+		respondJSON(w, r, http.StatusConflict, map[string]string{"error": "another allocation is in progress"})
+		return
+	}
+	defer allocBusy.Store(false)
+
+	before := readHeap()
+	buf := make([]byte, mb<<20)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1
+	}
+	held := readHeap()
+	log.Printf("level=warn msg=\"holding demo allocation\" mb=%d hold=%s heap_alloc_mb=%.1f", mb, hold, held.HeapAllocMB)
+	select {
+	case <-time.After(hold):
+	case <-r.Context().Done():
+	}
+	runtime.KeepAlive(buf)
+	debug.FreeOSMemory() // forces a GC and returns freed pages to the OS
+	after := readHeap()
+
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"allocated_mb": mb,
+		"held":         hold.String(),
+		"before":       before,
+		"held_heap":    held,
+		"after":        after,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAllocRaisesAndReleasesTheHeap(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	h := newHandler(newTestServer(t))
+	rec := serve(h, "POST", "/debug/alloc?mb=32&hold=0s", nil, "Authorization", "Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		MB     int          `json:"allocated_mb"`
+		Before heapSnapshot `json:"before"`
+		Held   heapSnapshot `json:"held_heap"`
+		After  heapSnapshot `json:"after"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.MB != 32 || body.Held.HeapAllocMB < body.Before.HeapAllocMB+30 {
+		t.Errorf("heap went %.1f -> %.1f MB, want a 32 MB rise", body.Before.HeapAllocMB, body.Held.HeapAllocMB)
+	}
+	if body.After.HeapAllocMB > body.Held.HeapAllocMB-30 || body.After.NumGC <= body.Held.NumGC {
+		t.Errorf("after release: %+v, want the 32 MB collected (held %+v)", body.After, body.Held)
+	}
+
+	for target, want := range map[string]int{
+		"/debug/alloc?mb=0":           http.StatusBadRequest,
+		"/debug/alloc?mb=100000":      http.StatusBadRequest,
+		"/debug/alloc?mb=1&hold=1h":   http.StatusBadRequest,
+		"/debug/alloc?mb=1&hold=fast": http.StatusBadRequest,
+	} {
+		if rec := serve(h, "POST", target, nil, "Authorization", "Bearer secret"); rec.Code != want {
+			t.Errorf("%s = %d, want %d", target, rec.Code, want)
+		}
+	}
+	if rec := serve(h, "POST", "/debug/alloc?mb=1", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setBacklog changes the accept queue length of an already listening socket.
+// net.Listen picks the backlog itself, but Linux accepts a second listen(2)
+// call on the socket and applies the new value; the kernel still caps it at
+// net.core.somaxconn.
+func setBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("cannot set backlog on %T", ln)
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	if listenErr != nil {
+		return fmt.Errorf("set listen backlog: %w", listenErr)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setBacklog is only implemented on Linux, the one platform where calling
+// listen(2) again on a listening socket changes its backlog.
+func setBacklog(net.Listener, int) error {
+	return errors.New("-listen-backlog is only supported on Linux")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the release version, set at build time with
+// -ldflags "-X main.version=v1.2.3". Unset, buildVersion falls back to what
+// the Go toolchain recorded.
+var version string
+
+// buildVersion returns version, else the module version or VCS revision from
+// the binary's build info, else "dev".
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return s.Value[:12]
+		}
+	}
+	return "dev"
+}
+
+// printBanner writes a boxed title and an aligned key/value block to w.
+// main sends it to stderr so stdout stays purely structured logs.
+func printBanner(w io.Writer, title string, fields [][2]string) {
+	width := 0
+	for _, f := range fields {
+		width = max(width, len(f[0]))
+	}
+	rule := "+" + strings.Repeat("-", len(title)+4) + "+"
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n|  %s  |\n%s\n", rule, title, rule)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "  %-*s  %s\n", width, f[0], f[1])
+	}
+	io.WriteString(w, b.String())
+}
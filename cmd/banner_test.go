@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBannerLayout(t *testing.T) {
+	var b strings.Builder
+	printBanner(&b, "preq-demo-app v1.2.3", [][2]string{{"addr", ":8080"}, {"request_timeout", "30s"}})
+	want := `+------------------------+
+|  preq-demo-app v1.2.3  |
++------------------------+
+  addr             :8080
+  request_timeout  30s
+`
+	if b.String() != want {
+		t.Errorf("banner =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestBuildVersionPrefersTheLinkedVersion(t *testing.T) {
+	setForTest(t, &version, "v9.9.9")
+	if got := buildVersion(); got != "v9.9.9" {
+		t.Errorf("buildVersion() = %q, want v9.9.9", got)
+	}
+	setForTest(t, &version, "")
+	if got := buildVersion(); got == "" {
+		t.Error("buildVersion() is empty without -X main.version")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// strictJSON makes JSON request decoding reject objects that repeat a key.
+// encoding/json accepts them and silently keeps the last value, so two
+// parsers reading the same body can disagree about what it says.
+var strictJSON bool
+
+// bufferedBody is the replacement r.Body installed by bufferBody. It keeps
+// the full payload so later callers can rewind instead of re-reading the
+// network stream, which by then has been drained.
+type bufferedBody struct {
+	*bytes.Reader
+	buf []byte
+}
+
+func (b *bufferedBody) Close() error { return nil }
+
+// bufferBody reads the request body, up to limit bytes, and replaces r.Body
+// with a rewound in-memory copy so middlewares and the handler can each read
+// it in full. Calling it again on the same request returns the buffered
+// bytes and rewinds the reader rather than reading from the client again.
+// Bodies over limit fail with *http.MaxBytesError, as with
+// http.MaxBytesReader. The limit counts decoded bytes, so it holds for chunked
+// bodies too, which have no Content-Length to check up front. The read stops
+// at the request context's deadline with os.ErrDeadlineExceeded rather than
+// waiting on a client that trickles data.
+func bufferBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if b, ok := r.Body.(*bufferedBody); ok {
+		b.Reset(b.buf)
+		return b.buf, nil
+	}
+	if deadline, ok := r.Context().Deadline(); ok {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err == nil {
+			// Cleared afterwards: net/http keeps reading the connection in
+			// the background and would take a passed deadline for a hang-up.
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+	buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		if bodyErrorStatus(err) == http.StatusRequestEntityTooLarge {
+			log.Printf("level=warn msg=\"request body too large\" path=%s limit=%d chunked=%t", r.URL.Path, limit, r.ContentLength < 0)
+		}
+		return nil, err
+	}
+	r.Body = &bufferedBody{Reader: bytes.NewReader(buf), buf: buf}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return buf, nil
+}
+
+// errEmptyBody reports a request body that is missing or only whitespace.
+// Callers check for it with errors.Is to pick their own answer, since an
+// empty body is an error for some endpoints and a default for others.
+var errEmptyBody = errors.New("empty request body")
+
+// isEmptyBody reports whether a buffered body carries no content.
+func isEmptyBody(buf []byte) bool {
+	return len(bytes.TrimSpace(buf)) == 0
+}
+
+// bodyErrorStatus is the status for a failed bufferBody or decodeJSONBody:
+// 413 for a body over the limit, 408 when the read hit the deadline, and 400
+// for anything else, such as malformed JSON.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// decodeJSONBody decodes the request body, up to limit bytes, into v, after
+// validateJSONBody accepts it. The body stays buffered on r for anything that
+// reads it afterwards.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, limit int64, v any) error {
+	buf, err := bufferBody(w, r, limit)
+	if err != nil {
+		return err
+	}
+	if err := validateJSONBody(buf); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// validateJSONBody runs the checks every JSON body gets before decoding. An
+// empty body fails with errEmptyBody rather than a JSON syntax error, one
+// nested past maxJSONDepth with errJSONTooDeep, and with strictJSON set one
+// repeating an object key with errDuplicateKey.
+func validateJSONBody(buf []byte) error {
+	if isEmptyBody(buf) {
+		return errEmptyBody
+	}
+	if err := checkJSONDepth(buf, maxJSONDepth); err != nil {
+		return err
+	}
+	if strictJSON {
+		return checkDuplicateKeys(buf)
+	}
+	return nil
+}
+
+// maxJSONDepth is the deepest nesting of objects and arrays accepted in a
+// JSON request body. encoding/json only stops at 10000 levels, far beyond
+// anything a real client sends.
+const maxJSONDepth = 64
+
+// errJSONTooDeep reports a body nested deeper than maxJSONDepth.
+var errJSONTooDeep = errors.New("JSON nested too deeply")
+
+// checkJSONDepth fails if data nests objects or arrays more than max levels
+// deep. It only tracks brackets outside strings, so it runs in one cheap
+// pass before any decoding; malformed JSON is left for the decoder.
+func checkJSONDepth(data []byte, max int) error {
+	depth, inString, escaped := 0, false, false
+	for _, c := range data {
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > max {
+				return fmt.Errorf("%w: more than %d levels", errJSONTooDeep, max)
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// errDuplicateKey reports an object that repeats a key.
+var errDuplicateKey = errors.New("duplicate key")
+
+// checkDuplicateKeys scans data token by token and fails on the first object
+// holding the same key twice, at any depth. Malformed JSON is left for the
+// real decode to report.
+func checkDuplicateKeys(data []byte) error {
+	type frame struct {
+		object    bool
+		expectKey bool
+		keys      map[string]bool
+	}
+	var stack []*frame
+	valueDone := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].expectKey = true
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				stack = append(stack, &frame{object: t == '{', expectKey: t == '{', keys: map[string]bool{}})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+		case string:
+			if n := len(stack); n > 0 && stack[n-1].expectKey {
+				top := stack[n-1]
+				if top.keys[t] {
+					return fmt.Errorf("%w %q", errDuplicateKey, t)
+				}
+				top.keys[t] = true
+				top.expectKey = false
+				continue
+			}
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferedBodyIsReadableTwice(t *testing.T) {
+	const payload = `{"name":"ada"}`
+	var seenByMiddleware, seenByHandler string
+	h := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		seenByHandler = string(b)
+	}))
+	logBody := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf, err := bufferBody(w, r, 1<<10)
+			if err != nil {
+				t.Fatalf("bufferBody: %v", err)
+			}
+			seenByMiddleware = string(buf)
+			next.ServeHTTP(w, r)
+		})
+	}
+	serve(logBody(h), "POST", "/", strings.NewReader(payload))
+	if seenByMiddleware != payload || seenByHandler != payload {
+		t.Errorf("middleware read %q, handler read %q, want both %q", seenByMiddleware, seenByHandler, payload)
+	}
+
+	// Buffering again rewinds instead of reading the drained stream.
+	r := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	w := httptest.NewRecorder()
+	first, _ := bufferBody(w, r, 1<<10)
+	io.ReadAll(r.Body)
+	if again, err := bufferBody(w, r, 1<<10); err != nil || string(again) != string(first) {
+		t.Errorf("second bufferBody = %q, %v; want %q", again, err, first)
+	}
+	if rest, _ := io.ReadAll(r.Body); string(rest) != payload {
+		t.Errorf("body after the second buffer = %q, want it rewound", rest)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	decode := func(body string) (map[string]any, error) {
+		var v map[string]any
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		return v, decodeJSONBody(httptest.NewRecorder(), r, 1<<10, &v)
+	}
+
+	setForTest(t, &strictJSON, false)
+	if v, err := decode(`{"a":1,"a":2}`); err != nil || v["a"] != 2.0 {
+		t.Errorf("lax: got %v %v, want a=2 (last value wins)", v, err)
+	}
+
+	setForTest(t, &strictJSON, true)
+	for _, body := range []string{`{"a":1,"a":2}`, `{"x":{"b":[1,{"c":1,"c":1}]}}`} {
+		if _, err := decode(body); !errors.Is(err, errDuplicateKey) {
+			t.Errorf("strict %s: err = %v, want errDuplicateKey", body, err)
+		}
+	}
+	if _, err := decode(`{"a":{"a":1},"b":[{"a":1},{"a":2}],"c":"a"}`); err != nil {
+		t.Errorf("strict: the same key in different objects: %v", err)
+	}
+}
+
+func TestEmptyBodyPerEndpoint(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	h := newHandler(newTestServer(t))
+	for _, tc := range []struct {
+		method, target string
+		body           io.Reader
+		want           int
+		wantBody       string
+	}{
+		{"POST", "/json-demo", nil, http.StatusBadRequest, "no JSON body provided"},
+		{"POST", "/json-demo", strings.NewReader(" \r\n\t"), http.StatusBadRequest, "no JSON body provided"},
+		{"PUT", "/admin/flags", nil, http.StatusBadRequest, "no flags provided"},
+		{"PUT", "/admin/flags", strings.NewReader("\n"), http.StatusBadRequest, "no flags provided"},
+		// /migrate reads no body: empty still means the legacy faulty migration.
+		{"POST", "/migrate", nil, http.StatusInternalServerError, "migration_failed"},
+		{"POST", "/migrate", strings.NewReader(""), http.StatusInternalServerError, "migration_failed"},
+	} {
+		rec := serve(h, tc.method, tc.target, tc.body, "Authorization", "Bearer secret")
+		if rec.Code != tc.want || !strings.Contains(rec.Body.String(), tc.wantBody) {
+			t.Errorf("%s %s with an empty body = %d %s, want %d %q", tc.method, tc.target, rec.Code, rec.Body, tc.want, tc.wantBody)
+		}
+	}
+}
+
+func TestChunkedBodies(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &routeTimeouts, map[string]time.Duration{"/json-demo": 200 * time.Millisecond})
+	ts := httptest.NewServer(newHandler(newTestServer(t)))
+	defer ts.Close()
+
+	post := func(body io.Reader) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", ts.URL+"/json-demo", body)
+		req.ContentLength = -1 // unknown length: sent chunked
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	if resp, body := post(io.MultiReader(strings.NewReader(`{"a":`), strings.NewReader(`1}`))); resp.StatusCode != http.StatusOK {
+		t.Errorf("small chunked body = %d %s, want 200", resp.StatusCode, body)
+	}
+
+	big := io.MultiReader(strings.NewReader(`{"pad":"`), strings.NewReader(strings.Repeat("x", maxJSONDemoBody)), strings.NewReader(`"}`))
+	if resp, body := post(big); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunked body = %d %s, want 413", resp.StatusCode, body)
+	}
+	if !strings.Contains(logs.String(), fmt.Sprintf(`msg="request body too large" path=/json-demo limit=%d chunked=true`, maxJSONDemoBody)) {
+		t.Errorf("oversized chunked body not logged:\n%s", logs)
+	}
+
+	// A client that stops sending mid-body is cut off at the route deadline.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte(`{"a":`))
+	start := time.Now()
+	if resp, body := post(pr); resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("stalled chunked body = %d %s, want 408", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled body took %s to time out, want about 200ms", elapsed)
+	}
+}
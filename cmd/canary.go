@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+var (
+	// canaryPercent is the share of requests, 0 to 100, on canaryRoutes that
+	// get the canary variant. 0 turns canarying off.
+	canaryPercent float64
+	// canaryRoutes are the paths canaryVariant applies to.
+	canaryRoutes = []string{"/"}
+	// canarySticky remembers each client's variant in canaryCookie, so a
+	// client keeps the variant it first got instead of one per request.
+	canarySticky bool
+)
+
+const (
+	canaryCookie = "demo_variant"
+
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+type variantKey struct{}
+
+// canaryVariant picks the variant r gets, or "" when r's path is not a
+// canary route. The pick hashes the request ID, salted so it does not line
+// up with log sampling, which hashes the same ID. In sticky mode a valid
+// cookie wins and a fresh pick is stored in one.
+func canaryVariant(w http.ResponseWriter, r *http.Request, reqID string) string {
+	if canaryPercent <= 0 || !slices.Contains(canaryRoutes, r.URL.Path) {
+		return ""
+	}
+	if canarySticky {
+		if c, err := r.Cookie(canaryCookie); err == nil && (c.Value == variantStable || c.Value == variantCanary) {
+			return c.Value
+		}
+	}
+	v := variantStable
+	if sampled("canary:"+reqID, canaryPercent/100) {
+		v = variantCanary
+	}
+	if canarySticky {
+		http.SetCookie(w, &http.Cookie{Name: canaryCookie, Value: v, Path: "/", MaxAge: 86400, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+	return v
+}
+
+// canaryMiddleware picks r's variant, announces it in X-Variant and passes it
+// to next through the context. It runs inside loggingMiddleware, whose
+// request ID it hashes and which reads X-Variant back for the access line.
+func canaryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := canaryVariant(w, r, w.Header().Get("X-Request-ID")); v != "" {
+			w.Header().Set("X-Variant", v)
+			r = r.WithContext(context.WithValue(r.Context(), variantKey{}, v))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestVariant returns the variant canaryMiddleware picked for the
+// request ctx belongs to, or "" if it is not canaried.
+func requestVariant(ctx context.Context) string {
+	v, _ := ctx.Value(variantKey{}).(string)
+	return v
+}
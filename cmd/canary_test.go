@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCanaryServesRoughlyItsPercentage(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &canaryPercent, 20)
+	h := newHandler(newTestServer(t))
+
+	const n = 1000
+	canaries := 0
+	for range n {
+		rec := serve(h, "GET", "/", nil)
+		switch v := rec.Header().Get("X-Variant"); v {
+		case variantCanary:
+			canaries++
+			if !strings.Contains(rec.Body.String(), "(canary)") {
+				t.Fatalf("canary response body %q", rec.Body)
+			}
+		case variantStable:
+		default:
+			t.Fatalf("X-Variant = %q", v)
+		}
+	}
+	if canaries < n*15/100 || canaries > n*25/100 {
+		t.Errorf("%d of %d requests got the canary, want about 20%%", canaries, n)
+	}
+	if !strings.Contains(logs.String(), " variant=canary") {
+		t.Error("access log has no variant=canary")
+	}
+	if rec := serve(h, "GET", "/deadline", nil); rec.Header().Get("X-Variant") != "" {
+		t.Error("a route outside -canary-routes got a variant")
+	}
+}
+
+func TestStickyCanaryKeepsTheClientsVariant(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &canaryPercent, 50)
+	setForTest(t, &canarySticky, true)
+	h := newHandler(newTestServer(t))
+
+	first := serve(h, "GET", "/", nil)
+	cookies := first.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != canaryCookie || cookies[0].Value != first.Header().Get("X-Variant") {
+		t.Fatalf("cookies = %v, want one %s cookie matching X-Variant %q", cookies, canaryCookie, first.Header().Get("X-Variant"))
+	}
+	for i := range 20 {
+		r := serve(h, "GET", "/", nil, "Cookie", cookies[0].String(), "X-Request-ID", fmt.Sprintf("sticky-%d", i))
+		if got := r.Header().Get("X-Variant"); got != cookies[0].Value {
+			t.Fatalf("request %d got %q, want the sticky %q", i, got, cookies[0].Value)
+		}
+		if r.Header().Get("Set-Cookie") != "" {
+			t.Fatalf("request %d reset the cookie", i)
+		}
+	}
+	if r := serve(h, "GET", "/", nil, "Cookie", canaryCookie+"=bogus"); r.Header().Get("Set-Cookie") == "" {
+		t.Error("an invalid cookie was not replaced")
+	}
+}
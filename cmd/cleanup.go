@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+type cleanupsKey struct{}
+
+// requestCleanups holds the functions registered with onRequestDone for one
+// request. Handlers may register from goroutines holding the request's
+// context, so access is locked.
+type requestCleanups struct {
+	mu   sync.Mutex
+	fns  []func()
+	done bool
+}
+
+// onRequestDone registers fn to run once the request ctx belongs to is over,
+// whether the handler returned normally or the client went away. Cleanups run
+// in reverse order of registration, like defers, after the handler returns.
+// A cleanup registered after that runs immediately. It reports false outside
+// loggingMiddleware, where nothing would run fn; the caller must then clean
+// up itself.
+func onRequestDone(ctx context.Context, fn func()) bool {
+	c, ok := ctx.Value(cleanupsKey{}).(*requestCleanups)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		runCleanup(fn)
+		return true
+	}
+	c.fns = append(c.fns, fn)
+	c.mu.Unlock()
+	return true
+}
+
+// run calls the registered cleanups last-in first-out. A panicking cleanup
+// is logged and does not stop the ones registered before it.
+func (c *requestCleanups) run() int {
+	c.mu.Lock()
+	fns := c.fns
+	c.fns, c.done = nil, true
+	c.mu.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		runCleanup(fns[i])
+	}
+	return len(fns)
+}
+
+func runCleanup(fn func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("level=error msg=\"request cleanup panicked\" panic=%v", v)
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCleanupsRunLIFO(t *testing.T) {
+	logs := captureLogs(t)
+	var order []string
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"first", "second", "third"} {
+			onRequestDone(r.Context(), func() { order = append(order, name) })
+		}
+		if r.URL.Query().Has("cancel") {
+			<-r.Context().Done()
+		}
+		order = append(order, "handler")
+	}))
+
+	serve(h, "GET", "/work", nil, "X-Request-ID", "done-1")
+	want := []string{"handler", "third", "second", "first"}
+	if !slices.Equal(order, want) {
+		t.Errorf("after normal completion: ran %v, want %v", order, want)
+	}
+	if line := logLine(logs.String(), "request_id=done-1 "); !strings.Contains(line, " cleanups=3") {
+		t.Errorf("access line = %q, want cleanups=3", line)
+	}
+
+	order = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, "GET", "/work?cancel", nil)
+	r.Header.Set("X-Request-ID", "canceled-1")
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !slices.Equal(order, want) {
+		t.Errorf("after cancellation: ran %v, want %v", order, want)
+	}
+
+	if onRequestDone(context.Background(), func() {}) {
+		t.Error("onRequestDone outside loggingMiddleware reported true")
+	}
+}
+
+func TestLateAndPanickingCleanups(t *testing.T) {
+	logs := captureLogs(t)
+	var ctx context.Context
+	var ran []string
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+		onRequestDone(ctx, func() { ran = append(ran, "before panic") })
+		onRequestDone(ctx, func() { panic("cleanup bug") })
+	}))
+	serve(h, "GET", "/work", nil)
+	if !slices.Equal(ran, []string{"before panic"}) || !strings.Contains(logs.String(), `msg="request cleanup panicked" panic=cleanup bug`) {
+		t.Errorf("ran %v, logs:\n%s", ran, logs)
+	}
+	// The request is over, so a late cleanup runs at once.
+	onRequestDone(ctx, func() { ran = append(ran, "late") })
+	if !slices.Equal(ran, []string{"before panic", "late"}) {
+		t.Errorf("late cleanup: ran %v", ran)
+	}
+}
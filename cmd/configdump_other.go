@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// startConfigDump is a no-op: SIGUSR2 only exists on Unix.
+func (s *server) startConfigDump() {}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startConfigDump logs the effective configuration each time the process
+// receives SIGUSR2, for operators who can send a signal more easily than
+// they can reach the port.
+func (s *server) startConfigDump() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	s.goWorker("config-dump", func(ctx context.Context) {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				logConfig("SIGUSR2")
+			}
+		}
+	})
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSIGUSR2DumpsConfigWithSecretsMasked(t *testing.T) {
+	logs := captureLogs(t)
+	// main registers the real flags; a stand-in set keeps the test's own
+	// -test.* flags out of the dump.
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	fs.StringVar(&adminToken, "admin-token", "", "")
+	fs.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "")
+	setForTest(t, &flag.CommandLine, fs)
+	setForTest(t, &adminToken, "")
+	setForTest(t, &requestTimeout, requestTimeout)
+	if err := fs.Parse([]string{"-admin-token=hunter2", "-request-timeout=750ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t)
+	s.startConfigDump()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "config dump") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	line := logLine(logs.String(), `msg="config dump"`)
+	if !strings.HasSuffix(line, `level=info msg="config dump" trigger=SIGUSR2 admin_token=[REDACTED] request_timeout=750ms`) {
+		t.Errorf("dump line = %q", line)
+	}
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("secret leaked into the log:\n%s", logs)
+	}
+}
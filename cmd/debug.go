@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+)
+
+// debugMode enables the debugging endpoints. They expose request internals and
+// must stay off in anything resembling production.
+var debugMode atomic.Bool
+
+// allocSampleRate is the fraction of requests allocMiddleware measures while
+// debug mode is on.
+var allocSampleRate = 0.01
+
+// allocMetrics are the process-wide cumulative counters allocMiddleware reads.
+var allocMetrics = []string{"/gc/heap/allocs:bytes", "/gc/heap/allocs:objects"}
+
+// allocMiddleware logs the heap allocations made while a sampled request was
+// being handled. The counters are process-wide, so anything else running at
+// the same time is attributed to the request too: the numbers are a rough
+// guide for demos, not a profile, and small allocations still sitting in a
+// per-P cache may not be counted yet. It does nothing unless debug mode is on.
+func allocMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !debugMode.Load() || allocSampleRate <= 0 || rand.Float64() >= allocSampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		before := readAllocs()
+		next.ServeHTTP(w, r)
+		after := readAllocs()
+		log.Printf("level=debug msg=\"request allocations\" path=%s request_id=%s alloc_bytes=%d allocs=%d",
+			r.URL.Path, orDash(w.Header().Get("X-Request-ID")), after[0]-before[0], after[1]-before[1])
+	})
+}
+
+func readAllocs() [2]uint64 {
+	samples := make([]metrics.Sample, len(allocMetrics))
+	for i, name := range allocMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	return [2]uint64{samples[0].Value.Uint64(), samples[1].Value.Uint64()}
+}
+
+// redactedHeaders are masked wherever request headers are echoed back.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// requireDebug hides the wrapped route unless -debug is set.
+func requireDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !debugMode.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactHeaders copies h, masking credentials and flattening repeated values.
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if redactedHeaders[k] {
+			out[k] = "[REDACTED]"
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// dumpHandler returns everything the server knows about the request.
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	var tlsInfo map[string]any
+	if r.TLS != nil {
+		scheme = "https"
+		tlsInfo = map[string]any{
+			"version":      tls.VersionName(r.TLS.Version),
+			"cipher_suite": tls.CipherSuiteName(r.TLS.CipherSuite),
+			"server_name":  r.TLS.ServerName,
+			"alpn":         r.TLS.NegotiatedProtocol,
+		}
+	}
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"method": r.Method,
+		"proto":  r.Proto,
+		"url": map[string]any{
+			"scheme":    scheme,
+			"host":      r.Host,
+			"path":      r.URL.Path,
+			"raw_query": r.URL.RawQuery,
+			"query":     r.URL.Query(),
+		},
+		"headers":     redactHeaders(r.Header),
+		"tls":         tlsInfo,
+		"remote_addr": r.RemoteAddr,
+		"client_ip":   clientIP(r),
+		"route":       r.Pattern,
+	})
+}
+
+// probeMethods are tried by routeDebugHandler to show where each method on
+// a path is routed.
+var probeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// routeDebugHandler reports how mux and trailingSlashMiddleware would route
+// ?path= for ?method= (default GET): the registered pattern that handles it,
+// the pattern each method would reach, and what the trailing-slash rule does
+// to it. pattern is empty when the router answers itself with status instead.
+func routeDebugHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		path := q.Get("path")
+		method := strings.ToUpper(q.Get("method"))
+		if method == "" {
+			method = http.MethodGet
+		}
+		if !strings.HasPrefix(path, "/") {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "path must start with /"})
+			return
+		}
+		probe, err := http.NewRequestWithContext(r.Context(), method, path, nil)
+		if err != nil {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "invalid path or method: " + err.Error()})
+			return
+		}
+		probe.Host = r.Host
+
+		resp := map[string]any{"path": path, "method": method, "trailing_slash": trailingSlash, "slash_outcome": "none"}
+		target := probe
+		if trimmed := trimTrailingSlash(mux, probe); trimmed != nil {
+			_, p := mux.Handler(trimmed)
+			resp["trimmed_path"], resp["trimmed_pattern"] = trimmed.URL.Path, p
+			switch trailingSlash {
+			case "redirect":
+				resp["slash_outcome"], resp["status"], resp["location"] = "redirect", http.StatusMovedPermanently, trimmed.URL.RequestURI()
+				target = nil
+			case "lenient":
+				resp["slash_outcome"] = "rewritten"
+				target = trimmed
+			default:
+				resp["slash_outcome"], resp["status"] = "not_found", http.StatusNotFound
+				target = nil
+			}
+		}
+		resp["pattern"] = ""
+		if target != nil {
+			methods := map[string]string{}
+			for _, m := range probeMethods {
+				p := target.Clone(r.Context())
+				p.Method = m
+				if _, pattern := mux.Handler(p); pattern != "" {
+					methods[m] = pattern
+				}
+			}
+			_, pattern := mux.Handler(target)
+			resp["pattern"], resp["methods"] = pattern, methods
+			switch {
+			case pattern != "":
+			case len(methods) > 0:
+				resp["status"] = http.StatusMethodNotAllowed
+			default:
+				resp["status"] = http.StatusNotFound
+			}
+		}
+		respondJSON(w, r, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDumpIsHiddenWithoutDebug(t *testing.T) {
+	captureLogs(t)
+	setDebugForTest(t, false)
+	if rec := serve(newHandler(newTestServer(t)), "GET", "/dump", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("/dump without -debug = %d, want 404", rec.Code)
+	}
+}
+
+func TestDumpReportsRequestMetadata(t *testing.T) {
+	captureLogs(t)
+	setDebugForTest(t, true)
+	rec := serve(newHandler(newTestServer(t)), "GET", "/dump?a=1", nil, "Authorization", "Bearer secret", "X-Trace", "t1")
+	var body struct {
+		Method   string            `json:"method"`
+		Proto    string            `json:"proto"`
+		ClientIP string            `json:"client_ip"`
+		Headers  map[string]string `json:"headers"`
+		URL      struct {
+			Path     string `json:"path"`
+			RawQuery string `json:"raw_query"`
+		} `json:"url"`
+		Route string `json:"route"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if body.Headers["Authorization"] != "[REDACTED]" || body.Headers["X-Trace"] != "t1" {
+		t.Errorf("headers = %v, want Authorization redacted and X-Trace kept", body.Headers)
+	}
+	if body.Method != "GET" || body.Proto != "HTTP/1.1" || body.ClientIP != "192.0.2.1" || body.Route != "GET /dump" || body.URL.Path != "/dump" || body.URL.RawQuery != "a=1" {
+		t.Errorf("dump = %+v", body)
+	}
+}
+
+func TestAllocationsAreLoggedInDebugMode(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &allocSampleRate, 1.0)
+	h := newHandler(newTestServer(t))
+
+	setDebugForTest(t, false)
+	serve(h, "GET", "/", nil)
+	if strings.Contains(logs.String(), "request allocations") {
+		t.Fatalf("allocations logged without -debug:\n%s", logs)
+	}
+
+	setDebugForTest(t, true)
+	serve(h, "GET", "/", nil)
+	line := logLine(logs.String(), `msg="request allocations"`)
+	if !regexp.MustCompile(`level=debug msg="request allocations" path=/ request_id=[^- ]\S* alloc_bytes=\d+ allocs=\d+$`).MatchString(line) {
+		t.Errorf("alloc line = %q", line)
+	}
+}
+
+func TestDebugRouteResolvesNormalizedPaths(t *testing.T) {
+	captureLogs(t)
+	setDebugForTest(t, true)
+	type route struct {
+		Pattern        string `json:"pattern"`
+		SlashOutcome   string `json:"slash_outcome"`
+		TrimmedPath    string `json:"trimmed_path"`
+		TrimmedPattern string `json:"trimmed_pattern"`
+		Status         int    `json:"status"`
+		Location       string `json:"location"`
+	}
+	for _, tc := range []struct {
+		mode, path string
+		want       route
+	}{
+		{"lenient", "/slow/", route{Pattern: "/slow", SlashOutcome: "rewritten", TrimmedPath: "/slow", TrimmedPattern: "/slow"}},
+		{"strict", "/slow/", route{SlashOutcome: "not_found", TrimmedPath: "/slow", TrimmedPattern: "/slow", Status: http.StatusNotFound}},
+		{"redirect", "/slow/?delay=1s", route{SlashOutcome: "redirect", TrimmedPath: "/slow", TrimmedPattern: "/slow", Status: http.StatusMovedPermanently, Location: "/slow?delay=1s"}},
+		{"strict", "/slow", route{Pattern: "/slow", SlashOutcome: "none"}},
+		// POST-only, so a GET falls through to the catch-all.
+		{"strict", "/warmup", route{Pattern: "/", SlashOutcome: "none"}},
+	} {
+		setForTest(t, &trailingSlash, tc.mode)
+		rec := serve(newHandler(newTestServer(t)), "GET", "/debug/route?path="+url.QueryEscape(tc.path), nil)
+		var got route
+		var methods struct {
+			Methods map[string]string `json:"methods"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d %s", tc.mode, tc.path, rec.Code, rec.Body)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &methods)
+		if got != tc.want {
+			t.Errorf("%s %s: got %+v, want %+v", tc.mode, tc.path, got, tc.want)
+		}
+		if tc.path == "/warmup" && methods.Methods["POST"] != "POST /warmup" {
+			t.Errorf("/warmup methods = %v, want POST /warmup", methods.Methods)
+		}
+	}
+
+	setDebugForTest(t, false)
+	if rec := serve(newHandler(newTestServer(t)), "GET", "/debug/route?path=/slow", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("/debug/route without -debug = %d, want 404", rec.Code)
+	}
+}
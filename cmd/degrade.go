@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// degradableFeatures are the optional response enrichments that can be shed
+// under load.
+var degradableFeatures = map[string]bool{
+	"pretty": true, // ?pretty / ?indent= JSON indentation
+}
+
+var (
+	degradeInFlight int             // shed enrichment above this many in-flight requests; 0 disables
+	degradeFeatures map[string]bool // which degradableFeatures to shed
+)
+
+type degradedKey struct{}
+
+// parseDegradeFeatures resolves a comma-separated list of degradableFeatures.
+func parseDegradeFeatures(spec string) (map[string]bool, error) {
+	out := make(map[string]bool)
+	for _, name := range splitList(spec) {
+		if !degradableFeatures[name] {
+			return nil, fmt.Errorf("unknown degradable feature %q", name)
+		}
+		out[name] = true
+	}
+	return out, nil
+}
+
+// fidelityMiddleware marks a request degraded when, counting itself, more
+// than degradeInFlight requests are in flight. Degraded requests take the
+// lean path for every feature in degradeFeatures and log degraded=true.
+func fidelityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if degradeInFlight > 0 && stats.inFlight.Load() > int64(degradeInFlight) {
+			r = r.WithContext(context.WithValue(r.Context(), degradedKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isDegraded reports whether fidelityMiddleware marked this request degraded.
+func isDegraded(ctx context.Context) bool {
+	v, _ := ctx.Value(degradedKey{}).(bool)
+	return v
+}
+
+// shed reports whether feature should be skipped for this request.
+func shed(r *http.Request, feature string) bool {
+	return degradeFeatures[feature] && isDegraded(r.Context())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHighInFlightShedsPrettyOutput(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &degradeInFlight, 2)
+	setForTest(t, &degradeFeatures, map[string]bool{"pretty": true})
+	h := newHandler(newTestServer(t))
+
+	if body := serve(h, "GET", "/?pretty", nil).Body.String(); !strings.Contains(body, "\n  ") {
+		t.Fatalf("idle server did not indent: %q", body)
+	}
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(h, "GET", "/slow?delay=300ms", nil)
+		}()
+	}
+	defer wg.Wait()
+	for stats.inFlight.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	rec := serve(h, "GET", "/?pretty", nil, "X-Request-ID", "under-load")
+	if body := rec.Body.String(); body != "{\"message\":\"demo service\"}\n" {
+		t.Errorf("under load /?pretty = %q, want compact output", body)
+	}
+	if line := logLine(logs.String(), "request_id=under-load"); !strings.Contains(line, " degraded=true") {
+		t.Errorf("access line %q lacks degraded=true", line)
+	}
+}
@@ -1,117 +1,526 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "modernc.org/sqlite" // pure-Go SQLite driver
 )
 
 var (
-	db        *sql.DB
-	panicMode bool
+	panicMode     atomic.Bool
+	startupErrors string
 )
 
+// server holds the state shared by the HTTP handlers. Each instance owns its
+// DB handle so several servers can run side by side without interfering.
+type server struct {
+	db           *sql.DB
+	limiter      *routeLimiter
+	ready        atomic.Bool
+	shuttingDown atomic.Bool
+	drainRefused atomic.Int64          // requests shutdownMiddleware answered 503
+	drift        atomic.Pointer[error] // set when warm-up stops on migration drift
+
+	health healthCache
+	stmts  stmtCache
+
+	hooksMu sync.Mutex
+	hooks   []shutdownHook
+
+	workerCtx     context.Context
+	cancelWorkers context.CancelFunc
+	workers       sync.WaitGroup
+	workersMu     sync.Mutex
+	running       map[string]int // live workers by name, for shutdown logs
+}
+
+// newServer returns a server backed by db, which may be nil in degraded mode.
+// It starts not-ready; warmUpLoop flips it once the DB is usable.
+func newServer(db *sql.DB) *server {
+	s := &server{db: db, running: make(map[string]int)}
+	s.workerCtx, s.cancelWorkers = context.WithCancel(context.Background())
+	if db != nil {
+		s.onShutdown("statements", func(context.Context) error { return s.stmts.close() })
+		s.onShutdown("db", func(context.Context) error { return db.Close() })
+	}
+	return s
+}
+
+// bindRetryDelay is how long continue mode waits before retrying a failed listen.
+const bindRetryDelay = 5 * time.Second
+
+// dbPoolSize caps open and idle DB connections.
+const dbPoolSize = 4
+
+// minMigrationTime is the least request time left for /migrate to start.
+const minMigrationTime = 100 * time.Millisecond
+
 func main() {
+	flag.StringVar(&appEnv, "env", appEnv, "error detail in responses: prod (code and request ID only) or dev (errors and stack traces)")
+	flag.StringVar(&logFormat, "log-format", "kv", "access log format: kv (key=value), clf (Common Log Format) or apache (Combined Log Format)")
+	accessLogFile := flag.String("access-log", "", "file to write access log lines to instead of the app log (default: mixed into stdout)")
+	flag.Float64Var(&logSampleRate, "log-sample-rate", 1, "fraction of fast 1xx-3xx requests to log unless -log-sample overrides the class")
+	sampleSpec := flag.String("log-sample", "", "per-status-class access-log sample rates, e.g. 2xx:0.1,3xx:0.5 (4xx/5xx are always logged)")
+	flag.DurationVar(&slowThreshold, "log-slow-threshold", time.Second, "requests taking at least this long are always logged, at level=warn")
+	flag.BoolVar(&logRoute, "log-route", false, "add the matched route pattern (route=...) to key=value access lines")
+	flag.DurationVar(&verySlowThreshold, "log-very-slow-threshold", verySlowThreshold, "requests taking at least this long are logged at level=error")
+	logFallback := flag.String("log-fallback", "", "file to append logs to if stdout becomes unwritable (default: drop them)")
+	logFile := flag.String("log-file", "", "file to append a copy of all logs to, alongside stdout")
+	dsn := flag.String("db-dsn", memoryDSN("demo.db"), "SQLite data source name")
+	flag.BoolVar(&dbReadOnly, "db-readonly", false, "open the DB read-only; migrations and other writes are rejected with 403")
+	flag.StringVar(&startupErrors, "startup-errors", "fail", "on DB or bind failure at startup: fail (exit) or continue (serve degraded)")
+	origins := flag.String("cors-origins", "", "comma-separated origins allowed by CORS, or * for any (default: CORS disabled)")
+	flag.IntVar(&corsMaxAge, "cors-max-age", 600, "seconds browsers may cache a CORS preflight result")
+	flag.BoolVar(&warmUpMigrate, "warmup-migrate", true, "apply pending schema migrations during warm-up")
+	flag.BoolVar(&warmUpPrepare, "warmup-prepare", true, "prepare frequently used SQL statements during warm-up")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token for admin endpoints such as /warmup (default: admin endpoints disabled)")
+	debug := flag.Bool("debug", false, "enable debugging endpoints such as /dump")
+	flag.Float64Var(&allocSampleRate, "alloc-sample-rate", allocSampleRate, "fraction of requests whose approximate heap allocations are logged in debug mode (0 disables)")
+	flag.DurationVar(&healthCacheTTL, "health-cache-ttl", healthCacheTTL, "how long /health and /readyz reuse a passing check result (0 disables caching)")
+	flag.DurationVar(&healthCacheFailTTL, "health-cache-fail-ttl", healthCacheFailTTL, "how long a failing check result is reused; at most -health-cache-ttl")
+	flag.IntVar(&healthDegradedStatus, "health-degraded-status", http.StatusOK, "status /health returns when degraded: 200 or 503")
+	flag.DurationVar(&shutdownDrain, "shutdown-drain", shutdownDrain, "how long to answer 503 before closing listeners on shutdown")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long in-flight requests get to finish on shutdown")
+	exempt := flag.String("shutdown-exempt", strings.Join(shutdownExempt, ","), "comma-separated paths that keep serving during the shutdown drain")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "deadline placed on each request's context (0 disables)")
+	flag.IntVar(&maxURILength, "max-uri-length", maxURILength, "longest request URI accepted before answering 414 (0 disables)")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", maxHeaderBytes, "largest request line plus headers accepted before answering 431")
+	flag.DurationVar(&slowMaxDelay, "slow-max-delay", slowMaxDelay, "upper bound on any delay /slow will sleep for")
+	slowSeed := flag.Uint64("slow-seed", 0, "seed for /slow's random delay distributions (default: seeded from the clock)")
+	flag.Float64Var(&globalRate, "rate", 0, "global requests per second across all routes (0 disables)")
+	flag.IntVar(&globalBurst, "burst", globalBurst, "global rate limiter burst size")
+	flag.Float64Var(&ipRate, "ip-rate", 0, "requests per second allowed per client IP, on top of -rate (0 disables)")
+	flag.IntVar(&ipBurst, "ip-burst", ipBurst, "per-client rate limiter burst size")
+	routeTimeout := flag.String("route-timeout", "", "per-route request timeouts overriding -request-timeout, e.g. /slow:10s (path:duration, comma-separated)")
+	flag.DurationVar(&handlerHardLimit, "handler-hard-limit", 0, "log the stack of any handler still running after this long, to catch ones ignoring their timeout; 0 disables it")
+	routeRate := flag.String("route-rate", "", "per-route limits overriding -rate, e.g. /migrate:1:1 (path:rps:burst, comma-separated)")
+	flag.IntVar(&degradeInFlight, "degrade-in-flight", 0, "shed optional response enrichment above this many in-flight requests (0 disables)")
+	degrade := flag.String("degrade-features", "pretty", "comma-separated enrichments shed when degraded: pretty")
+	flag.Float64Var(&canaryPercent, "canary-percent", 0, "percentage (0-100) of requests on -canary-routes served the canary variant; 0 disables canarying")
+	canaryRoutesFlag := flag.String("canary-routes", "/", "comma-separated paths -canary-percent applies to")
+	flag.BoolVar(&canarySticky, "canary-sticky", false, "keep each client on its first variant with a "+canaryCookie+" cookie")
+	flag.DurationVar(&metricsLogInterval, "metrics-log-interval", 0, "log a metrics snapshot (request and error rate, p99, in-flight, DB pool) this often; 0 disables it")
+	flag.Float64Var(&goroutineSampleRate, "goroutine-sample-rate", goroutineSampleRate, "fraction of /panic and /panic-sync requests checked for leftover goroutines")
+	flag.Func("response-headers", "extra response header as \"Name: value\", added to every response unless the handler sets it (repeatable)", parseResponseHeader)
+	flag.StringVar(&trailingSlash, "trailing-slash", trailingSlash, "how /route/ is handled for a registered /route: strict (404), redirect (301) or lenient (same as /route)")
+	banner := flag.Bool("banner", false, "print a startup banner with the version and key settings to stderr")
+	flag.BoolVar(&jsonTrailingNewline, "json-trailing-newline", true, "end JSON response bodies with a newline, as encoding/json does; false strips it")
+	flag.BoolVar(&strictJSON, "strict-json", false, "reject JSON request bodies that repeat an object key (default: last value wins)")
+	flag.BoolVar(&reusePort, "reuseport", false, "set SO_REUSEPORT so several processes can share the port (Linux, macOS, BSD)")
+	flag.IntVar(&listenBacklog, "listen-backlog", 0, "accept queue length for the listener (Linux only; 0 keeps the system default)")
+	proxies := flag.String("trusted-proxies", "", "comma-separated CIDRs or IPs of proxies whose X-Forwarded-For is believed for client IPs (default: none)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file; with -tls-key serves HTTPS instead of HTTP")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file for -tls-cert")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", tlsMinVersion, "lowest TLS version accepted: 1.2 or 1.3")
+	flag.StringVar(&tlsCiphers, "tls-ciphers", "", "comma-separated TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default: Go's secure set)")
+	noKeepAlive := flag.Bool("disable-keepalive", false, "close every connection after one request (watch reuse_ratio in /stats drop to 0)")
+	printCfg := flag.Bool("print-config", false, "print the effective configuration as command-line flags and exit")
+	printSecrets := flag.Bool("print-config-secrets", false, "with -print-config, include secrets such as -admin-token instead of redacting them")
+	selfTest := flag.Bool("self-test", false, "run an in-process smoke test of every handler and exit instead of serving")
+	rules := flag.String("path-rules", "", "comma-separated suspicious-path rules to reject with 400: dotdot, null, ctrl (default: none)")
+	flag.Parse()
+	debugMode.Store(*debug)
+	if *slowSeed != 0 {
+		seedSlowRNG(*slowSeed)
+	}
+	corsOrigins = splitList(*origins)
+	shutdownExempt = splitList(*exempt)
+
 	// Simple key=value log format
-	log.SetOutput(os.Stdout)
+	if err := setupLogOutput(*logFallback, *logFile, *accessLogFile); err != nil {
+		log.Fatalf("level=fatal msg=\"failed to open log file\" err=%v", err)
+	}
+
+	if healthCacheFailTTL > healthCacheTTL {
+		log.Fatalf("level=fatal msg=\"health-cache-fail-ttl exceeds health-cache-ttl\" health_cache_ttl=%s health_cache_fail_ttl=%s", healthCacheTTL, healthCacheFailTTL)
+	}
+	if err := parseRouteTimeouts(*routeTimeout); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid route timeouts\" err=%v", err)
+	}
+	if trailingSlash != "strict" && trailingSlash != "redirect" && trailingSlash != "lenient" {
+		log.Fatalf("level=fatal msg=\"invalid trailing-slash mode\" trailing_slash=%s", trailingSlash)
+	}
+	if appEnv != envDev && appEnv != envProd {
+		log.Fatalf("level=fatal msg=\"invalid env\" env=%s", appEnv)
+	}
+	if verySlowThreshold < slowThreshold {
+		log.Fatalf("level=fatal msg=\"log-very-slow-threshold is below log-slow-threshold\" log_slow_threshold=%s log_very_slow_threshold=%s", slowThreshold, verySlowThreshold)
+	}
+	if logFormat != "kv" && logFormat != "clf" && logFormat != "apache" {
+		log.Fatalf("level=fatal msg=\"invalid log format\" log_format=%s", logFormat)
+	}
+	if logSampleRate < 0 || logSampleRate > 1 {
+		log.Fatalf("level=fatal msg=\"invalid log sample rate\" log_sample_rate=%g", logSampleRate)
+	}
+	var err error
+	if sampleRates, err = parseSampleSpec(*sampleSpec, logSampleRate); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid log sample spec\" err=%v", err)
+	}
+	if degradeFeatures, err = parseDegradeFeatures(*degrade); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid degrade features\" err=%v", err)
+	}
+	if pathRules, err = parsePathRules(*rules); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid path rules\" err=%v", err)
+	}
+	if trustedProxies, err = parseTrustedProxies(*proxies); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid trusted proxies\" err=%v", err)
+	}
+	if healthDegradedStatus != http.StatusOK && healthDegradedStatus != http.StatusServiceUnavailable {
+		log.Fatalf("level=fatal msg=\"invalid health degraded status\" health_degraded_status=%d", healthDegradedStatus)
+	}
+	if startupErrors != "fail" && startupErrors != "continue" {
+		log.Fatalf("level=fatal msg=\"invalid startup error mode\" startup_errors=%s", startupErrors)
+	}
+	if canaryPercent < 0 || canaryPercent > 100 {
+		log.Fatalf("level=fatal msg=\"invalid canary percent\" canary_percent=%g", canaryPercent)
+	}
+	canaryRoutes = splitList(*canaryRoutesFlag)
+	if handlerHardLimit < 0 {
+		log.Fatalf("level=fatal msg=\"invalid handler hard limit\" handler_hard_limit=%s", handlerHardLimit)
+	}
+	if metricsLogInterval < 0 {
+		log.Fatalf("level=fatal msg=\"invalid metrics log interval\" metrics_log_interval=%s", metricsLogInterval)
+	}
+
+	if *printCfg {
+		printConfig(os.Stdout, *printSecrets)
+		return
+	}
+	if *selfTest {
+		os.Exit(runSelfTest())
+	}
 
-	initDB()
+	if dbReadOnly {
+		*dsn = readOnlyDSN(*dsn)
+	}
+	db, err := openDB(*dsn)
+	if err != nil {
+		if startupErrors != "continue" {
+			log.Fatalf("level=fatal msg=\"failed to open db\" err=%v", err)
+		}
+		log.Printf("level=error msg=\"failed to open db, starting degraded\" err=%v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	panicMode = strings.ToLower(os.Getenv("PANIC")) == ""
-	log.Printf("level=info msg=\"configuration\" panic_mode=%t", panicMode)
+	srv := newServer(db)
+	if srv.limiter, err = newRouteLimiter(*routeRate, globalRate, globalBurst); err != nil {
+		log.Fatalf("level=fatal msg=\"invalid rate limits\" err=%v", err)
+	}
+	if ipRate > 0 {
+		if ipBurst < 1 {
+			log.Fatalf("level=fatal msg=\"invalid ip burst\" ip_burst=%d", ipBurst)
+		}
+		srv.limiter.perIP = newIPLimiter(ipRate, ipBurst)
+		srv.goWorker("ip-limiter-evict", srv.limiter.perIP.evictLoop)
+	}
+	if db != nil {
+		srv.goWorker("warm-up", srv.warmUpLoop)
+	}
+	if metricsLogInterval > 0 {
+		srv.goWorker("metrics-log", srv.metricsLogLoop)
+	}
+	srv.startConfigDump()
 
-	// Register HTTP handlers (badjson route removed, new /migrate route added)
-	http.Handle("/", loggingMiddleware(http.HandlerFunc(rootHandler)))
-	http.Handle("/panic", loggingMiddleware(http.HandlerFunc(panicHandler)))
-	http.Handle("/slow", loggingMiddleware(http.HandlerFunc(slowHandler)))
-	http.Handle("/migrate", loggingMiddleware(http.HandlerFunc(migrationHandler)))
-	http.Handle("/health", http.HandlerFunc(healthHandler))
+	panicMode.Store(strings.ToLower(os.Getenv("PANIC")) == "")
+	log.Printf("level=info msg=\"configuration\" env=%s panic_mode=%t log_format=%s log_sample_rate=%g log_slow_threshold=%s startup_errors=%s", appEnv, panicMode.Load(), logFormat, logSampleRate, slowThreshold, startupErrors)
 
 	addr := ":8080"
-	log.Printf("level=info msg=\"starting server\" addr=%s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("level=fatal msg=\"server exited\" err=%v", err)
+	if *banner {
+		printBanner(os.Stderr, "preq-demo-app "+buildVersion(), [][2]string{
+			{"addr", addr},
+			{"env", appEnv},
+			{"db", *dsn},
+			{"db_readonly", strconv.FormatBool(dbReadOnly)},
+			{"log_format", logFormat},
+			{"panic_mode", strconv.FormatBool(panicMode.Load())},
+			{"debug", strconv.FormatBool(debugMode.Load())},
+			{"admin", strconv.FormatBool(adminToken != "")},
+			{"request_timeout", requestTimeout.String()},
+		})
+	}
+	httpServer := &http.Server{
+		Addr:           addr,
+		Handler:        newHandler(srv),
+		MaxHeaderBytes: maxHeaderBytes,
+		ConnState:      stats.trackConn,
+	}
+	httpServer.SetKeepAlivesEnabled(!*noKeepAlive)
+	useTLS := tlsCert != "" || tlsKey != ""
+	if useTLS {
+		if tlsCert == "" || tlsKey == "" {
+			log.Fatalf("level=fatal msg=\"-tls-cert and -tls-key must be set together\"")
+		}
+		if httpServer.TLSConfig, err = newTLSConfig(); err != nil {
+			log.Fatalf("level=fatal msg=\"invalid TLS configuration\" err=%v", err)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		srv.gracefulShutdown(httpServer)
+		close(stopped)
+	}()
+
+	for {
+		log.Printf("level=info msg=\"starting server\" addr=%s tls=%t", addr, useTLS)
+		ln, err := listen(addr)
+		if err == nil && useTLS {
+			err = httpServer.ServeTLS(ln, tlsCert, tlsKey)
+		} else if err == nil {
+			err = httpServer.Serve(ln)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			<-stopped
+			return
+		}
+		if startupErrors != "continue" {
+			log.Fatalf("level=fatal msg=\"server exited\" err=%v", err)
+		}
+		log.Printf("level=error msg=\"server exited, retrying\" err=%v retry_in=%s", err, bindRetryDelay)
+		time.Sleep(bindRetryDelay)
 	}
 }
 
-// initDB opens an in‑memory SQLite database used solely to demonstrate migration failures.
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite", "file:demo.db?cache=shared&mode=memory")
-	if err != nil {
-		log.Fatalf("level=fatal msg=\"failed to open db\" err=%v", err)
+// newHandler wraps the router in the middleware that applies to every route.
+func newHandler(s *server) http.Handler {
+	mux := newRouter(s)
+	var h http.Handler = timeoutMiddleware(watchdogMiddleware(mux))
+	if s.limiter != nil {
+		h = s.limiter.middleware(h)
 	}
+	h = trailingSlashMiddleware(mux, h)
+	return uriLimitMiddleware(stats.countRequests(allocMiddleware(responseHeaderMiddleware(fidelityMiddleware(s.shutdownMiddleware(headerLimitMiddleware(pathGuardMiddleware(corsMiddleware(h)))))))))
 }
 
-// loggingMiddleware logs request/response metadata in a uniform format.
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(lrw, r)
-		duration := time.Since(start)
-		log.Printf("level=info method=%s path=%s status=%d duration=%s", r.Method, r.URL.Path, lrw.statusCode, duration)
-	})
+// routeTimeouts gives routes their own request deadline in place of
+// -request-timeout. Entries match the exact path; -route-timeout adds or
+// overrides them.
+var routeTimeouts = map[string]time.Duration{
+	"/":        time.Second,
+	"/slow":    10 * time.Second,
+	"/migrate": 30 * time.Second,
 }
 
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// newRouter registers the service's routes against s.
+func newRouter(s *server) *http.ServeMux {
+	mux := http.NewServeMux()
+	// logged is the per-route chain for routes with an access log line.
+	logged := func(h http.Handler) http.Handler { return loggingMiddleware(canaryMiddleware(h)) }
+	// Register HTTP handlers (badjson route removed, new /migrate route added)
+	mux.Handle("/", logged(http.HandlerFunc(rootHandler)))
+	mux.Handle("/panic", logged(goroutineWatch(http.HandlerFunc(panicHandler))))
+	mux.Handle("/slow", logged(http.HandlerFunc(slowHandler)))
+	mux.Handle("/json-demo", logged(http.HandlerFunc(jsonDemoHandler)))
+	mux.Handle("/race-demo", logged(http.HandlerFunc(raceDemoHandler)))
+	mux.Handle("/echo", logged(http.HandlerFunc(echoHandler)))
+	mux.Handle("/deadline", logged(http.HandlerFunc(deadlineHandler)))
+	mux.Handle("/panic-sync", logged(goroutineWatch(recoverMiddleware(http.HandlerFunc(panicSyncHandler)))))
+	mux.Handle("/migrate", logged(s.requireDB(requireWritable(http.HandlerFunc(s.migrationHandler)))))
+	mux.Handle("POST /warmup", logged(requireAdmin(s.requireDB(http.HandlerFunc(s.warmupHandler)))))
+	mux.Handle("POST /debug/alloc", logged(requireAdmin(http.HandlerFunc(allocHandler))))
+	mux.Handle("/admin/flags", logged(requireAdmin(http.HandlerFunc(flagsHandler))))
+	mux.Handle("GET /dump", logged(requireDebug(http.HandlerFunc(dumpHandler))))
+	mux.Handle("GET /debug/route", logged(requireDebug(routeDebugHandler(mux))))
+	mux.Handle("/stats", http.HandlerFunc(statsHandler))
+	mux.Handle("/metrics", http.HandlerFunc(metricsHandler))
+	mux.Handle("/ping", http.HandlerFunc(pingHandler))
+	mux.Handle("/health", http.HandlerFunc(s.healthHandler))
+	mux.Handle("/livez", http.HandlerFunc(livezHandler))
+	mux.Handle("/readyz", http.HandlerFunc(s.readyHandler))
+	return mux
+}
+
+// memoryDSN names a shared-cache in-memory SQLite database. Connections using
+// the same name see the same data; distinct names are fully isolated.
+func memoryDSN(name string) string {
+	return "file:" + name + "?mode=memory&cache=shared"
+}
+
+// openDB opens an in‑memory SQLite database used solely to demonstrate migration failures.
+// The connection is pinged so an unusable DSN is reported here rather than on first use.
+func openDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.SetMaxOpenConns(dbPoolSize)
+	db.SetMaxIdleConns(dbPoolSize)
+	return db, nil
 }
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
+// errDBUnavailable is returned by DB helpers called while the server is
+// running degraded without a DB.
+var errDBUnavailable = errors.New("database unavailable")
+
+// requireDB returns 503 for DB-backed routes while the DB is unavailable.
+func (s *server) requireDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.db == nil {
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // rootHandler returns a basic JSON payload.
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{"message": "demo service"})
+	if requestVariant(r.Context()) == variantCanary {
+		respondJSON(w, r, http.StatusOK, map[string]string{"message": "demo service (canary)"})
+		return
+	}
+	respondJSON(w, r, http.StatusOK, map[string]string{"message": "demo service"})
+}
+
+var pong = []byte("pong")
+
+// pingHandler is the cheapest route there is, for baselining latency: no
+// JSON, no DB and no access log unless it was slow. The duration runs from
+// when the request reached the middleware chain, since the handler's own
+// work is a single buffered write.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(pong)
+	if d := time.Since(requestStart(r.Context())); d >= slowThreshold {
+		log.Printf("level=warn msg=\"slow ping\" duration=%s", d)
+	}
 }
 
 // panicHandler triggers a panic inside a goroutine. The goroutine recovers so the service stays up.
 func panicHandler(w http.ResponseWriter, r *http.Request) {
-	if !panicMode {
-		respondJSON(w, http.StatusOK, map[string]string{"status": "panic disabled"})
+	if !panicMode.Load() {
+		respondJSON(w, r, http.StatusOK, map[string]string{"status": "panic disabled"})
 		return
 	}
 
 	go func() {
 		panic("intentional panic inside goroutine for demo purposes")
 	}()
-	respondJSON(w, http.StatusOK, map[string]string{"status": "goroutine panic triggered"})
+	respondJSON(w, r, http.StatusOK, map[string]string{"status": "goroutine panic triggered"})
 }
 
-// slowHandler simulates a slow request and logs if the client cancels.
+// slowHandler simulates a slow request and logs if the client cancels. The
+// delay comes from slowDelay.
 func slowHandler(w http.ResponseWriter, r *http.Request) {
+	delay, err := slowDelay(r.URL.Query())
+	if err != nil {
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
 	ctx := r.Context()
+	addLogField(ctx, "delay", delay)
+	if left := remaining(ctx); delay > left {
+		log.Printf("level=warn msg=\"not enough time left, refusing to start\" path=%s delay=%s remaining=%s", r.URL.Path, delay, left)
+		respondJSON(w, r, http.StatusGatewayTimeout, map[string]string{
+			"error": fmt.Sprintf("delay %s exceeds the %s left before the request deadline", delay, left.Round(time.Millisecond)),
+		})
+		return
+	}
 	select {
-	case <-time.After(6 * time.Second):
-		respondJSON(w, http.StatusOK, map[string]string{"status": "slow response"})
+	case <-time.After(delay):
+		log.Printf("level=info msg=\"slow response delivered\" path=%s delay=%s source=%s", r.URL.Path, delay, slowDelaySource(r.URL.Query()))
+		respondJSON(w, r, http.StatusOK, map[string]string{"status": "slow response", "delay": delay.String()})
 	case <-ctx.Done():
-		log.Printf("level=error msg=\"context canceled\" path=%s err=%v", r.URL.Path, ctx.Err())
+		cause := cancelCause(ctx)
+		log.Printf("level=error msg=\"context canceled\" path=%s cause=%s err=%v", r.URL.Path, cause, ctx.Err())
+		if cause != "client_cancel" {
+			// The server's deadline fired, so the client is still listening.
+			respondJSON(w, r, http.StatusGatewayTimeout, map[string]string{"error": "request timed out"})
+		}
+	}
+}
+
+// deadlineHandler reports how long the request has left before its context
+// deadline, as set by timeoutMiddleware.
+func deadlineHandler(w http.ResponseWriter, r *http.Request) {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		log.Println("level=info msg=\"request deadline\" deadline=none")
+		respondJSON(w, r, http.StatusOK, map[string]any{"has_deadline": false, "message": "no deadline set on this request"})
+		return
 	}
+	remaining := time.Until(deadline)
+	log.Printf("level=info msg=\"request deadline\" remaining=%s", remaining)
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"has_deadline": true,
+		"deadline":     deadline.Format(time.RFC3339Nano),
+		"remaining":    remaining.String(),
+		"remaining_ms": remaining.Milliseconds(),
+	})
 }
 
 // migrationHandler deliberately runs a faulty SQL migration to demonstrate error logging.
-func migrationHandler(w http.ResponseWriter, r *http.Request) {
-	if err := runFaultyMigration(); err != nil {
+// It reads no request body, so POSTs with an empty or missing one run the same
+// faulty migration.
+func (s *server) migrationHandler(w http.ResponseWriter, r *http.Request) {
+	if left := remaining(r.Context()); left < minMigrationTime {
+		log.Printf("level=warn msg=\"not enough time left, refusing to start\" path=%s remaining=%s need=%s", r.URL.Path, left, minMigrationTime)
+		respondJSON(w, r, http.StatusServiceUnavailable, map[string]string{"error": "not enough time left in the request to run a migration"})
+		return
+	}
+	// requireDB normally screens this out; checked again so the handler is
+	// safe on its own.
+	if s.db == nil {
+		log.Printf("level=error msg=\"migration skipped, database unavailable\" path=%s", r.URL.Path)
+		respondError(w, r, http.StatusServiceUnavailable, "database_unavailable", "database unavailable", errDBUnavailable, nil)
+		return
+	}
+	// The migration's queries get their own context, cancelled by a request
+	// cleanup so nothing outlives the request even on an early return.
+	ctx, cancel := context.WithCancel(r.Context())
+	if !onRequestDone(r.Context(), cancel) {
+		defer cancel()
+	}
+	if err := retryBusy(ctx, "faulty_migration", func() error { return runFaultyMigration(ctx, s.db) }); err != nil {
+		if errors.Is(err, errDBUnavailable) {
+			respondError(w, r, http.StatusServiceUnavailable, "database_unavailable", "database unavailable", err, nil)
+			return
+		}
+		addLogField(r.Context(), "sqlite_code", sqliteCode(err))
+		if isReadOnly(err) {
+			log.Printf("level=error msg=\"migration rejected, database is read-only\" err=%v", err)
+			respondReadOnly(w, r)
+			return
+		}
+		if isBusy(err) {
+			log.Printf("level=error msg=\"migration failed, database busy\" retries=%d err=%v", busyRetries, err)
+			respondError(w, r, http.StatusServiceUnavailable, "database_busy", "database busy", err, nil)
+			return
+		}
 		log.Printf("level=error msg=\"migration failed\" err=%v", err)
-		http.Error(w, "migration failed", http.StatusInternalServerError)
+		respondError(w, r, http.StatusInternalServerError, "migration_failed", "migration failed", err, nil)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"status": "migration succeeded (unexpected)"})
+	respondJSON(w, r, http.StatusOK, map[string]string{"status": "migration succeeded (unexpected)"})
 }
 
-func runFaultyMigration() error {
-	tx, err := db.Begin()
+func runFaultyMigration(ctx context.Context, db *sql.DB) error {
+	if db == nil {
+		return errDBUnavailable
+	}
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin tx: %w", err)
 	}
@@ -120,24 +529,60 @@ func runFaultyMigration() error {
 	log.Println("level=info msg=\"running migration\"")
 
 	// Intentional error: altering a non‑existent table
-	if _, err := tx.Exec("ALTER TABLE imaginary ADD COLUMN foo TEXT"); err != nil {
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE imaginary ADD COLUMN foo TEXT"); err != nil {
 		return fmt.Errorf("alter table: %w", err)
 	}
 
 	return tx.Commit()
 }
 
-// healthHandler is a quiet liveness probe.
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "ok")
-}
+// jsonTrailingNewline keeps the newline json.Encoder appends to every
+// response body. Some strict clients reject it, so it can be turned off.
+var jsonTrailingNewline = true
 
-// respondJSON writes a JSON response and logs encoding failures.
-func respondJSON(w http.ResponseWriter, code int, payload interface{}) {
+// respondJSON writes a JSON response and logs encoding failures. Output is
+// compact unless the request asks for indentation (see jsonIndent). Without
+// jsonTrailingNewline the body is buffered so the final newline can be cut.
+func respondJSON(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
+	var buf bytes.Buffer
+	var out io.Writer = w
+	if !jsonTrailingNewline {
+		out = &buf
+	}
+	enc := json.NewEncoder(out)
+	if indent := jsonIndent(r); indent != "" && !shed(r, "pretty") {
+		enc.SetIndent("", indent)
+	}
+	if err := enc.Encode(payload); err != nil {
 		log.Printf("level=error msg=\"failed to encode json\" err=%v payload=%#v", err, payload)
 	}
+	if !jsonTrailingNewline {
+		w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+}
+
+// maxJSONIndent is the widest indentation ?indent= accepts.
+const maxJSONIndent = 8
+
+// jsonIndent returns the indentation requested by ?indent=N (1-8 spaces) or
+// ?indent=tab, with ?pretty as shorthand for two spaces. Anything invalid
+// falls back to compact output.
+func jsonIndent(r *http.Request) string {
+	q := r.URL.Query()
+	if v := q.Get("indent"); v != "" {
+		if v == "tab" {
+			return "\t"
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxJSONIndent {
+			return ""
+		}
+		return strings.Repeat(" ", n)
+	}
+	if q.Has("pretty") && q.Get("pretty") != "false" {
+		return "  "
+	}
+	return ""
 }
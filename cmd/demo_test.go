@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDBs numbers the test databases so each newTestServer gets its own.
+var testDBs atomic.Int64
+
+// newTestServer returns a server on a private in-memory DB named after the
+// test, with the schema migrations applied and readiness set. The DB and
+// the server's workers are closed when the test ends.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := openDB(memoryDSN(fmt.Sprintf("%s-%d", name, testDBs.Add(1))))
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	s := newServer(db)
+	t.Cleanup(func() {
+		s.cancelWorkers()
+		s.workers.Wait()
+		s.stmts.close()
+		db.Close()
+	})
+	if err := s.warmUp(t.Context()); err != nil {
+		t.Fatalf("warmUp: %v", err)
+	}
+	s.ready.Store(true)
+	return s
+}
+
+// setForTest sets *p to v for the rest of the test. Most configuration is
+// package-level, so tests that change it must not run in parallel.
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// setDebugForTest turns debug mode on or off for the rest of the test.
+func setDebugForTest(t *testing.T, on bool) {
+	t.Helper()
+	old := debugMode.Load()
+	debugMode.Store(on)
+	t.Cleanup(func() { debugMode.Store(old) })
+}
+
+// syncBuffer is a bytes.Buffer safe for loggers written from several
+// goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the app and access logs to a buffer until the test ends.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	accessLog.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		accessLog.SetOutput(os.Stdout)
+	})
+	return buf
+}
+
+// logLine returns the first line of logs containing substr, or "".
+func logLine(logs, substr string) string {
+	for line := range strings.SplitSeq(logs, "\n") {
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
+
+// serve sends one request through h and returns the recorded response.
+func serve(h http.Handler, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestServersHaveIsolatedDatabases(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	if _, err := a.db.Exec("CREATE TABLE only_in_a (id INTEGER)"); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	var n int
+	if err := b.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'only_in_a'").Scan(&n); err != nil {
+		t.Fatalf("query b: %v", err)
+	}
+	if n != 0 {
+		t.Fatal("table created on server a is visible on server b")
+	}
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'only_in_a'").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("table missing on server a: n=%d err=%v", n, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowThreshold, time.Hour)
+	h := newHandler(newTestServer(t))
+	rec := serve(h, "GET", "/ping", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "pong" {
+		t.Fatalf("got %d %q, want 200 pong", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if strings.Contains(logs.String(), "path=/ping") || strings.Contains(logs.String(), "slow ping") {
+		t.Errorf("fast ping was logged:\n%s", logs)
+	}
+}
+
+func TestSlowPingIsTimedFromArrival(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowThreshold, 20*time.Millisecond)
+	// Stall before the handler runs, as a slow middleware would.
+	h := stats.countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		pingHandler(w, r)
+	}))
+	serve(h, "GET", "/ping", nil)
+	if !strings.Contains(logs.String(), `msg="slow ping"`) {
+		t.Errorf("no slow ping warning:\n%s", logs)
+	}
+}
+
+func BenchmarkPing(b *testing.B) {
+	db, err := openDB(memoryDSN("bench-ping"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	h := newHandler(newServer(db))
+	r := httptest.NewRequest("GET", "/ping", nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func TestJSONIndent(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+	for query, want := range map[string]string{
+		"?indent=4":   "{\n    \"message\": \"demo service\"\n}\n",
+		"?indent=tab": "{\n\t\"message\": \"demo service\"\n}\n",
+		"?pretty":     "{\n  \"message\": \"demo service\"\n}\n",
+		"?indent=99":  "{\"message\":\"demo service\"}\n",
+		"?indent=abc": "{\"message\":\"demo service\"}\n",
+		"":            "{\"message\":\"demo service\"}\n",
+	} {
+		if got := serve(h, "GET", "/"+query, nil).Body.String(); got != want {
+			t.Errorf("/%s body = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestJSONTrailingNewline(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+	for _, tc := range []struct {
+		keep        bool
+		query, want string
+	}{
+		{true, "", "{\"message\":\"demo service\"}\n"},
+		{true, "?pretty", "{\n  \"message\": \"demo service\"\n}\n"},
+		{false, "", "{\"message\":\"demo service\"}"},
+		{false, "?pretty", "{\n  \"message\": \"demo service\"\n}"},
+	} {
+		setForTest(t, &jsonTrailingNewline, tc.keep)
+		if got := serve(h, "GET", "/"+tc.query, nil).Body.String(); got != tc.want {
+			t.Errorf("-json-trailing-newline=%t /%s body = %q, want %q", tc.keep, tc.query, got, tc.want)
+		}
+	}
+	setForTest(t, &jsonTrailingNewline, false)
+	if got := serve(h, "POST", "/json-demo", nil).Body.String(); !strings.HasPrefix(got, "{") || strings.HasSuffix(got, "\n") {
+		t.Errorf("JSON error body = %q, want it without the newline", got)
+	}
+}
+
+func TestDeadlineReportsRemainingTime(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &requestTimeout, 5*time.Second)
+	rec := serve(newHandler(newTestServer(t)), "GET", "/deadline", nil)
+	var body struct {
+		HasDeadline bool  `json:"has_deadline"`
+		RemainingMS int64 `json:"remaining_ms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	if !body.HasDeadline || body.RemainingMS <= 0 || body.RemainingMS > 5000 {
+		t.Errorf("got %+v, want a deadline with 0-5000ms left", body)
+	}
+	if rec := serve(http.HandlerFunc(deadlineHandler), "GET", "/deadline", nil); !strings.Contains(rec.Body.String(), `"has_deadline":false`) {
+		t.Errorf("without the timeout middleware: %s", rec.Body)
+	}
+}
+
+func TestSlowRefusesAnUnfinishableDelay(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &routeTimeouts, maps.Clone(routeTimeouts))
+	if err := parseRouteTimeouts("/slow:100ms"); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newTestServer(t))
+
+	start := time.Now()
+	rec := serve(h, "GET", "/slow?delay=1s", nil)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("/slow took %s to refuse, want it to answer at once", elapsed)
+	}
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "exceeds the") {
+		t.Errorf("got %d %s, want 504 naming the deadline", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `msg="not enough time left, refusing to start" path=/slow delay=1s`) {
+		t.Errorf("refusal not logged:\n%s", logs)
+	}
+	if rec := serve(h, "GET", "/slow?delay=10ms", nil); rec.Code != http.StatusOK {
+		t.Errorf("a delay that fits = %d, want 200", rec.Code)
+	}
+}
+
+func TestNilDBAnswers503(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	s := newServer(nil)
+	h := newHandler(s)
+	for _, c := range []struct{ method, target string }{
+		{"GET", "/migrate"},
+		{"POST", "/migrate"},
+		{"POST", "/warmup"},
+	} {
+		if rec := serve(h, c.method, c.target, nil, "Authorization", "Bearer secret"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "database unavailable") {
+			t.Errorf("%s %s = %d %q, want 503 database unavailable", c.method, c.target, rec.Code, rec.Body)
+		}
+	}
+	// Without requireDB in front, the handler still refuses rather than panics.
+	rec := serve(timeoutMiddleware(http.HandlerFunc(s.migrationHandler)), "POST", "/migrate", nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "database_unavailable") {
+		t.Errorf("bare migrationHandler = %d %s, want 503 database_unavailable", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `msg="migration skipped, database unavailable" path=/migrate`) {
+		t.Errorf("skipped migration not logged:\n%s", logs)
+	}
+	if err := runFaultyMigration(t.Context(), nil); !errors.Is(err, errDBUnavailable) {
+		t.Errorf("runFaultyMigration(nil) = %v, want errDBUnavailable", err)
+	}
+	if _, err := s.primePool(t.Context()); !errors.Is(err, errDBUnavailable) {
+		t.Errorf("primePool without a DB = %v, want errDBUnavailable", err)
+	}
+}
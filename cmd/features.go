@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+// maxFlagsBody bounds PUT /admin/flags request bodies.
+const maxFlagsBody = 64 << 10
+
+// features maps runtime-toggleable behaviours to the switches that control
+// them. The map itself is fixed at startup; only the values change, and
+// they're atomics so the code reading them needs no locking.
+var features = map[string]*atomic.Bool{
+	"panic": &panicMode,
+	"debug": &debugMode,
+}
+
+func featureSnapshot() map[string]bool {
+	out := make(map[string]bool, len(features))
+	for name, v := range features {
+		out[name] = v.Load()
+	}
+	return out
+}
+
+// flagsHandler reports feature flags on GET and updates them on PUT from a
+// JSON object of name to bool. Unknown names reject the whole update.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var update map[string]bool
+		err := decodeJSONBody(w, r, maxFlagsBody, &update)
+		if errors.Is(err, errEmptyBody) {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "no flags provided"})
+			return
+		}
+		if err != nil {
+			respondJSON(w, r, bodyErrorStatus(err), map[string]string{"error": "invalid JSON body: " + err.Error()})
+			return
+		}
+		for name := range update {
+			if features[name] == nil {
+				respondJSON(w, r, http.StatusBadRequest, map[string]any{
+					"error": "unknown flag " + name,
+					"known": slices.Sorted(maps.Keys(features)),
+				})
+				return
+			}
+		}
+		for name, v := range update {
+			if old := features[name].Swap(v); old != v {
+				log.Printf("level=info msg=\"feature flag changed\" flag=%s value=%t", name, v)
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	respondJSON(w, r, http.StatusOK, featureSnapshot())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestToggledFlagChangesTheNextRequest(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	setDebugForTest(t, false)
+	h := newHandler(newTestServer(t))
+	auth := []string{"Authorization", "Bearer secret"}
+
+	if rec := serve(h, "GET", "/dump", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("/dump with debug off = %d, want 404", rec.Code)
+	}
+	rec := serve(h, "PUT", "/admin/flags", strings.NewReader(`{"debug":true}`), auth...)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"debug":true`) {
+		t.Fatalf("PUT /admin/flags = %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(h, "GET", "/dump", nil); rec.Code != http.StatusOK {
+		t.Errorf("/dump after enabling debug = %d, want 200", rec.Code)
+	}
+	if !strings.Contains(logs.String(), `msg="feature flag changed" flag=debug value=true`) {
+		t.Errorf("flag change not logged:\n%s", logs)
+	}
+
+	rec = serve(h, "PUT", "/admin/flags", strings.NewReader(`{"debug":false,"bogus":true}`), auth...)
+	if rec.Code != http.StatusBadRequest || !debugMode.Load() {
+		t.Errorf("update with an unknown flag = %d, debug %t; want 400 and nothing changed", rec.Code, debugMode.Load())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds each individual health check.
+const healthCheckTimeout = time.Second
+
+// healthDegradedStatus is the status /health returns when only non-critical
+// checks fail.
+var healthDegradedStatus = http.StatusOK
+
+// Health check results are reused for healthCacheTTL, or healthCacheFailTTL
+// if the check failed, so rapid probes don't each hit the DB. The failure TTL
+// may be shorter but never longer, so recovery is noticed at least as fast.
+var (
+	healthCacheTTL     = time.Second
+	healthCacheFailTTL = time.Second
+)
+
+// healthCache holds the latest result of each health check. Each entry has
+// its own lock, held while the check runs, so concurrent probes that miss the
+// cache wait for one check instead of all running it.
+type healthCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedCheck
+}
+
+type cachedCheck struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// run returns c's cached result if it is still fresh, otherwise runs c.
+func (hc *healthCache) run(ctx context.Context, c healthCheck) error {
+	hc.mu.Lock()
+	if hc.entries == nil {
+		hc.entries = make(map[string]*cachedCheck)
+	}
+	e, ok := hc.entries[c.name]
+	if !ok {
+		e = &cachedCheck{}
+		hc.entries[c.name] = e
+	}
+	hc.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ttl := healthCacheTTL
+	if e.err != nil {
+		ttl = healthCacheFailTTL
+	}
+	if !e.at.IsZero() && time.Since(e.at) < ttl {
+		return e.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	e.err = c.check(ctx)
+	e.at = time.Now()
+	return e.err
+}
+
+// healthCheck is one input to /health. A failing critical check makes the
+// service unhealthy; a failing non-critical one only degrades it.
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+func (s *server) healthChecks() []healthCheck {
+	return []healthCheck{
+		{"db", true, s.checkDB},
+		{"migrations", false, s.checkMigrations},
+	}
+}
+
+func (s *server) checkDB(ctx context.Context) error {
+	if s.db == nil {
+		return errors.New("database unavailable")
+	}
+	return s.db.PingContext(ctx)
+}
+
+// checkMigrations reports whether every known migration has been applied.
+func (s *server) checkMigrations(ctx context.Context) error {
+	if s.db == nil {
+		return errors.New("database unavailable")
+	}
+	st, err := s.stmts.get(ctx, s.db, queryMigrationCount)
+	if err != nil {
+		return err
+	}
+	var applied int
+	if err := st.QueryRowContext(ctx).Scan(&applied); err != nil {
+		return err
+	}
+	if applied < len(migrations) {
+		return fmt.Errorf("%d of %d migrations applied", applied, len(migrations))
+	}
+	return nil
+}
+
+// healthHandler aggregates healthChecks into healthy (200), degraded
+// (healthDegradedStatus) or unhealthy (503). It bypasses the logging
+// middleware so frequent probes stay quiet.
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := "healthy"
+	results := make(map[string]string)
+	for _, c := range s.healthChecks() {
+		err := s.health.run(r.Context(), c)
+		if err == nil {
+			results[c.name] = "ok"
+			continue
+		}
+		results[c.name] = err.Error()
+		if c.critical {
+			status = "unhealthy"
+		} else if status == "healthy" {
+			status = "degraded"
+		}
+	}
+
+	code := http.StatusOK
+	switch status {
+	case "degraded":
+		code = healthDegradedStatus
+	case "unhealthy":
+		code = http.StatusServiceUnavailable
+	}
+	respondJSON(w, r, code, map[string]any{"status": status, "checks": results})
+}
+
+// livezHandler is a quiet liveness probe.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// readyHandler reports whether the service can handle DB-backed traffic: warm-up
+// has finished and the (cached) DB check passes. An instance stuck on
+// migration drift says so, since it will never become ready by itself.
+func (s *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.drift.Load(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready: ", *err)
+		return
+	}
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready")
+		return
+	}
+	if err := s.health.run(r.Context(), healthCheck{"db", true, s.checkDB}); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "not ready: db: ", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthOf fetches /health from s and decodes its status.
+func healthOf(t *testing.T, s *server) (int, string) {
+	t.Helper()
+	rec := serve(newHandler(s), "GET", "/health", nil)
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	return rec.Code, body.Status
+}
+
+func TestHealthStates(t *testing.T) {
+	captureLogs(t)
+	unmigrated, err := openDB(memoryDSN("health-unmigrated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmigrated.Close()
+
+	for _, tc := range []struct {
+		name       string
+		s          *server
+		degraded   int
+		wantCode   int
+		wantStatus string
+	}{
+		{"healthy", newTestServer(t), http.StatusOK, http.StatusOK, "healthy"},
+		{"degraded", newServer(unmigrated), http.StatusOK, http.StatusOK, "degraded"},
+		{"degraded as 503", newServer(unmigrated), http.StatusServiceUnavailable, http.StatusServiceUnavailable, "degraded"},
+		{"unhealthy", newServer(nil), http.StatusOK, http.StatusServiceUnavailable, "unhealthy"},
+	} {
+		setForTest(t, &healthDegradedStatus, tc.degraded)
+		if code, status := healthOf(t, tc.s); code != tc.wantCode || status != tc.wantStatus {
+			t.Errorf("%s: got %d %s, want %d %s", tc.name, code, status, tc.wantCode, tc.wantStatus)
+		}
+	}
+}
+
+func TestHealthCacheRunsEachCheckOncePerTTL(t *testing.T) {
+	setForTest(t, &healthCacheTTL, 100*time.Millisecond)
+	setForTest(t, &healthCacheFailTTL, 20*time.Millisecond)
+	var hc healthCache
+	var pings atomic.Int64
+	var fail atomic.Bool
+	c := healthCheck{"db", true, func(context.Context) error {
+		pings.Add(1)
+		if fail.Load() {
+			return errors.New("down")
+		}
+		return nil
+	}}
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.run(t.Context(), c)
+		}()
+	}
+	wg.Wait()
+	for range 50 {
+		hc.run(t.Context(), c)
+	}
+	if n := pings.Load(); n != 1 {
+		t.Fatalf("100 checks within the TTL pinged %d times, want 1", n)
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	fail.Store(true)
+	if err := hc.run(t.Context(), c); err == nil || pings.Load() != 2 {
+		t.Fatalf("after the TTL: err=%v pings=%d, want a fresh failing check", err, pings.Load())
+	}
+	// A failure is only kept for the shorter failure TTL.
+	fail.Store(false)
+	time.Sleep(30 * time.Millisecond)
+	if err := hc.run(t.Context(), c); err != nil || pings.Load() != 3 {
+		t.Errorf("after the failure TTL: err=%v pings=%d, want recovery noticed", err, pings.Load())
+	}
+}
+
+func TestReadyzReusesTheCachedDBCheck(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &healthCacheTTL, time.Hour)
+	s := newTestServer(t)
+	if rec := serve(newHandler(s), "GET", "/readyz", nil); rec.Code != http.StatusOK {
+		t.Fatalf("/readyz = %d %s", rec.Code, rec.Body)
+	}
+	// With the DB gone, only a cached result can keep /readyz green.
+	s.db.Close()
+	for i := range 20 {
+		if rec := serve(newHandler(s), "GET", "/readyz", nil); rec.Code != http.StatusOK {
+			t.Fatalf("/readyz %d within the TTL = %d %s, want the cached 200", i, rec.Code, rec.Body)
+		}
+	}
+}
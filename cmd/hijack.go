@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// echoIdleTimeout closes a hijacked echo connection after this long
+	// without input.
+	echoIdleTimeout = 10 * time.Second
+	// maxEchoBytes caps how much one echo connection may send.
+	maxEchoBytes = 64 << 10
+)
+
+// echoHandler takes over the connection and echoes raw bytes back, to show
+// http.Hijacker at work. Clients opt in with "Connection: Upgrade" and
+// "Upgrade: echo"; the handler answers 101 itself and from then on speaks
+// plain TCP. Other requests get 426, and HTTP/2, which can't be hijacked, gets
+// 505 so the client can retry over HTTP/1.1.
+//
+// Once hijacked, net/http no longer manages the connection: the handler owns
+// deadlines and closing it, and Shutdown won't wait for it. The request
+// context still applies, so -request-timeout closes the connection too.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "echo") || !headerHasToken(r.Header, "Connection", "upgrade") {
+		w.Header().Set("Upgrade", "echo")
+		w.Header().Set("Connection", "Upgrade")
+		respondJSON(w, r, http.StatusUpgradeRequired, map[string]string{"error": "send Connection: Upgrade and Upgrade: echo to switch to a raw echo stream"})
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		respondJSON(w, r, http.StatusHTTPVersionNotSupported, map[string]string{"error": "connection cannot be hijacked over " + r.Proto + "; retry with HTTP/1.1"})
+		return
+	}
+	if err != nil {
+		log.Printf("level=error msg=\"hijack failed\" path=%s err=%v", r.URL.Path, err)
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(r.Context(), func() { conn.Close() })
+	defer stop()
+
+	if _, err := brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	start := time.Now()
+	var echoed int64
+	buf := make([]byte, 4<<10)
+	for echoed < maxEchoBytes {
+		conn.SetReadDeadline(time.Now().Add(echoIdleTimeout))
+		n, err := brw.Read(buf[:min(int64(len(buf)), maxEchoBytes-echoed)])
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+			echoed += int64(n)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("level=debug msg=\"echo connection ended\" path=%s echoed=%d err=%v", r.URL.Path, echoed, err)
+			}
+			break
+		}
+	}
+	log.Printf("level=info msg=\"echo connection closed\" path=%s echoed=%d duration=%s", r.URL.Path, echoed, time.Since(start))
+}
+
+// headerHasToken reports whether any comma-separated element of header name
+// is token, compared case-insensitively, as in "Connection: keep-alive, Upgrade".
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoHijacksTheConnection(t *testing.T) {
+	logs := captureLogs(t)
+	ts := httptest.NewServer(newHandler(newTestServer(t)))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: demo\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read 101: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	for _, msg := range []string{"hello", "raw bytes\x00\xff"} {
+		io.WriteString(conn, msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(br, got); err != nil || string(got) != msg {
+			t.Fatalf("echo = %q %v, want %q", got, err, msg)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("after half-close read = %v, want EOF", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "path=/echo status=101") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if line := logLine(logs.String(), `msg="echo connection closed"`); !strings.Contains(line, "echoed=16") {
+		t.Errorf("close line = %q, want echoed=16", line)
+	}
+	if !strings.Contains(logs.String(), "path=/echo status=101") {
+		t.Errorf("hijacked request not logged as 101:\n%s", logs)
+	}
+}
+
+func TestEchoFallsBackWithoutHijack(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+	for _, header := range [][]string{
+		nil,
+		{"Upgrade", "echo"},
+		{"Upgrade", "echo", "Connection", "keep-alive"},
+		{"Connection", "Upgrade"},
+	} {
+		if rec := serve(h, "GET", "/echo", nil, header...); rec.Code != http.StatusUpgradeRequired || rec.Header().Get("Upgrade") != "echo" {
+			t.Errorf("headers %q = %d Upgrade=%q, want 426 echo", header, rec.Code, rec.Header().Get("Upgrade"))
+		}
+	}
+	if rec := serve(h, "GET", "/echo", nil, "Connection", "keep-alive, Upgrade", "Upgrade", "ECHO"); rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("Upgrade token in a Connection list = %d, want it accepted (505 here, as the recorder can't be hijacked)", rec.Code)
+	}
+	// httptest.ResponseRecorder, like HTTP/2, can't be hijacked.
+	if rec := serve(h, "GET", "/echo", nil, "Connection", "Upgrade", "Upgrade", "echo"); rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("unhijackable writer = %d, want 505", rec.Code)
+	}
+}
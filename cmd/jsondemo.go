@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+)
+
+// maxJSONDemoBody bounds POST /json-demo request bodies.
+const maxJSONDemoBody = 64 << 10
+
+// numberLoss records a number whose decoded value differs from what was sent.
+type numberLoss struct {
+	Path    string `json:"path"`
+	Sent    string `json:"sent"`
+	Decoded string `json:"decoded"`
+}
+
+// jsonDemoHandler decodes the posted JSON and echoes it back, showing what
+// happens to numbers along the way. By default the decoder turns every
+// number into a float64, so integers above 2^53 and long decimals come back
+// altered; ?use_number=true switches on json.Decoder.UseNumber, which keeps
+// each number as its original literal.
+func jsonDemoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	useNumber := false
+	if v := r.URL.Query().Get("use_number"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "use_number must be a boolean"})
+			return
+		}
+		useNumber = b
+	}
+
+	buf, err := bufferBody(w, r, maxJSONDemoBody)
+	if err != nil {
+		respondJSON(w, r, bodyErrorStatus(err), map[string]string{"error": "reading body: " + err.Error()})
+		return
+	}
+	if err := validateJSONBody(buf); errors.Is(err, errEmptyBody) {
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "no JSON body provided"})
+		return
+	} else if err != nil {
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	// The reference decode always uses UseNumber so the sent literals are
+	// available to compare against.
+	ref, err := decodeJSONValue(buf, true)
+	if err != nil {
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+	got, err := decodeJSONValue(buf, useNumber)
+	if err != nil {
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	lost := []numberLoss{}
+	compareNumbers(ref, got, "$", &lost)
+	addLogField(r.Context(), "numbers_lost", len(lost))
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"use_number":          useNumber,
+		"echo":                got,
+		"precision_preserved": len(lost) == 0,
+		"precision_lost":      lost,
+	})
+}
+
+func decodeJSONValue(buf []byte, useNumber bool) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if useNumber {
+		dec.UseNumber()
+	}
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// compareNumbers walks ref, decoded with UseNumber, alongside got and
+// appends every number whose value changed. Literals that differ only in
+// spelling ("1.0" and "1") compare equal.
+func compareNumbers(ref, got any, path string, lost *[]numberLoss) {
+	switch rv := ref.(type) {
+	case map[string]any:
+		gv, _ := got.(map[string]any)
+		for k, v := range rv {
+			compareNumbers(v, gv[k], path+"."+k, lost)
+		}
+	case []any:
+		gv, _ := got.([]any)
+		for i, v := range rv {
+			if i < len(gv) {
+				compareNumbers(v, gv[i], fmt.Sprintf("%s[%d]", path, i), lost)
+			}
+		}
+	case json.Number:
+		out, err := json.Marshal(got)
+		if err != nil {
+			return
+		}
+		sent, _, err1 := big.ParseFloat(rv.String(), 10, 256, big.ToNearestEven)
+		decoded, _, err2 := big.ParseFloat(string(out), 10, 256, big.ToNearestEven)
+		if err1 != nil || err2 != nil || sent.Cmp(decoded) != 0 {
+			*lost = append(*lost, numberLoss{Path: path, Sent: rv.String(), Decoded: string(out)})
+		}
+	}
+}
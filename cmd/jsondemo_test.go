@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONDemoValidatesLikeEveryJSONRoute(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &strictJSON, true)
+	h := newHandler(newTestServer(t))
+	deep := strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1)
+	for _, tc := range []struct{ body, wantErr string }{
+		{"", "no JSON body provided"},
+		{"  \n", "no JSON body provided"},
+		{deep, "JSON nested too deeply"},
+		{`{"a":1,"a":2}`, "duplicate key"},
+	} {
+		rec := serve(h, "POST", "/json-demo", strings.NewReader(tc.body))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.wantErr) {
+			t.Errorf("body %.20q: got %d %s, want 400 %q", tc.body, rec.Code, rec.Body, tc.wantErr)
+		}
+	}
+}
+
+func TestJSONDemoReportsPrecisionLoss(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+	body := `{"id":9007199254740993,"ok":1}`
+	for _, tc := range []struct {
+		query     string
+		preserved bool
+	}{{"", false}, {"?use_number=true", true}} {
+		rec := serve(h, "POST", "/json-demo"+tc.query, strings.NewReader(body))
+		var resp struct {
+			Preserved bool         `json:"precision_preserved"`
+			Lost      []numberLoss `json:"precision_lost"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", tc.query, rec.Code, rec.Body)
+		}
+		if resp.Preserved != tc.preserved {
+			t.Errorf("%q: precision_preserved = %t, want %t (lost %v)", tc.query, resp.Preserved, tc.preserved, resp.Lost)
+		}
+		if tc.preserved && !strings.Contains(rec.Body.String(), `"id":9007199254740993`) {
+			t.Errorf("%q: echo %s, want the integer back exactly", tc.query, rec.Body)
+		}
+		if !tc.preserved && (len(resp.Lost) != 1 || resp.Lost[0].Path != "$.id") {
+			t.Errorf("%q: precision_lost = %v, want only $.id", tc.query, resp.Lost)
+		}
+	}
+}
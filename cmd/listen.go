@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Socket tuning for the HTTP listener. Go already sets SO_REUSEADDR on Unix
+// listeners, so a restarted server can rebind while old connections sit in
+// TIME_WAIT; reusePort additionally lets several processes bind the same port
+// and have the kernel spread connections between them.
+var (
+	reusePort     bool
+	listenBacklog int // 0 keeps the system default (net.core.somaxconn on Linux)
+)
+
+// listen opens the TCP listener for addr with reusePort and listenBacklog
+// applied, logging what was set. Options the platform can't do fail here
+// rather than being silently ignored.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: socketControl}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if listenBacklog > 0 {
+		if err := setBacklog(ln, listenBacklog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	log.Printf("level=info msg=\"listening\" addr=%s so_reuseport=%t backlog=%s", ln.Addr(), reusePort, backlogValue())
+	return ln, nil
+}
+
+func backlogValue() string {
+	if listenBacklog <= 0 {
+		return "default"
+	}
+	return strconv.Itoa(listenBacklog)
+}
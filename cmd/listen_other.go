@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func socketControl(network, address string, c syscall.RawConn) error {
+	if reusePort {
+		return errors.New("-reuseport is not supported on this platform")
+	}
+	return nil
+}
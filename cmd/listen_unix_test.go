@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReusePortLetsTwoListenersShareAPort(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &reusePort, true)
+	a, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := listen(a.Addr().String())
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", a.Addr(), err)
+	}
+	defer b.Close()
+	if !strings.Contains(logs.String(), "addr="+a.Addr().String()+" so_reuseport=true backlog=default") {
+		t.Errorf("socket options not logged:\n%s", logs)
+	}
+
+	setForTest(t, &reusePort, false)
+	if c, err := listen(a.Addr().String()); !errors.Is(err, syscall.EADDRINUSE) {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("without -reuseport: err = %v, want EADDRINUSE", err)
+	}
+}
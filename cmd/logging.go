@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	logFormat     string
+	logSampleRate float64
+	slowThreshold time.Duration
+	// verySlowThreshold is the duration from which access lines log at
+	// level=error; from slowThreshold up to it they log at level=warn.
+	verySlowThreshold = 10 * time.Second
+	// logRoute adds the matched route pattern, such as "POST /warmup", to
+	// key=value access lines next to the raw path. Patterns are few and
+	// fixed, so they group requests without the path's cardinality.
+	logRoute  bool
+	accessLog = log.New(os.Stdout, "", 0)
+)
+
+// setupLogOutput points the app and access loggers at stdout through a
+// safeWriter, teeing to logFile as well when one is given. A non-empty
+// accessPath sends access lines to that file alone, keeping them out of the
+// app log. SIGPIPE is ignored so a closed stdout pipe surfaces as a write
+// error instead of killing the process.
+func setupLogOutput(fallbackPath, logFile, accessPath string) error {
+	signal.Ignore(syscall.SIGPIPE)
+	stdout := &safeWriter{primary: os.Stdout}
+	if fallbackPath != "" {
+		f, err := openLogFile(fallbackPath)
+		if err != nil {
+			return err
+		}
+		stdout.fallback = f
+	}
+	out := &teeWriter{dsts: []io.Writer{stdout}}
+	if logFile != "" {
+		f, err := openLogFile(logFile)
+		if err != nil {
+			return err
+		}
+		out.dsts = append(out.dsts, f)
+	}
+	log.SetOutput(out)
+	accessLog.SetOutput(out)
+	if logFormat == "kv" {
+		// kv access lines share the app log's timestamp prefix.
+		accessLog.SetFlags(log.LstdFlags)
+	}
+	if accessPath != "" {
+		f, err := openLogFile(accessPath)
+		if err != nil {
+			return err
+		}
+		accessLog.SetOutput(&safeWriter{primary: f})
+	}
+	return nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// teeWriter copies each log line to every destination under one lock, so
+// lines from the app and access loggers never interleave. A failing
+// destination doesn't stop the others.
+type teeWriter struct {
+	mu   sync.Mutex
+	dsts []io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, w := range t.dsts {
+		w.Write(p)
+	}
+	return len(p), nil
+}
+
+// safeWriter never reports write errors to its caller. After the first failed
+// write to primary it gives up on it and sends everything to fallback, or
+// drops it when no fallback is configured.
+type safeWriter struct {
+	mu       sync.Mutex
+	primary  io.Writer
+	fallback io.Writer
+	failed   bool
+	dropped  int64
+}
+
+func (w *safeWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.failed {
+		_, err := w.primary.Write(p)
+		if err == nil {
+			return len(p), nil
+		}
+		w.failed = true
+		if w.fallback != nil {
+			fmt.Fprintf(w.fallback, "%s level=warn msg=\"log output failed, using fallback\" err=%v\n", time.Now().Format("2006/01/02 15:04:05"), err)
+		}
+	}
+	if w.fallback == nil {
+		w.dropped++
+		return len(p), nil
+	}
+	w.fallback.Write(p)
+	return len(p), nil
+}
+
+// loggingMiddleware logs request/response metadata in a uniform format.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqID := requestID(r)
+		w.Header().Set("X-Request-ID", reqID)
+		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		fields := &logFields{}
+		cleanups := &requestCleanups{}
+		ctx := context.WithValue(r.Context(), logFieldsKey{}, fields)
+		r = r.WithContext(context.WithValue(ctx, cleanupsKey{}, cleanups))
+		defer cleanups.run() // no-op unless the handler panicked
+		next.ServeHTTP(lrw, r)
+		if n := cleanups.run(); n > 0 {
+			addLogField(r.Context(), "cleanups", n)
+		}
+		duration := time.Since(start)
+		stats.recordOutcome(r.Context())
+		latencies.observe(lrw.statusCode, duration)
+		if lrw.writeErr != nil {
+			log.Printf("level=debug msg=\"client disconnected\" path=%s request_id=%s writes=%d bytes=%d err=%v",
+				r.URL.Path, reqID, lrw.writes, lrw.bytesWritten, lrw.writeErr)
+		}
+		if !shouldLog(reqID, lrw.statusCode, duration) {
+			return
+		}
+		switch logFormat {
+		case "apache":
+			accessLog.Print(combinedLogLine(r, lrw, start))
+			return
+		case "clf":
+			accessLog.Print(commonLogLine(r, lrw, start))
+			return
+		}
+		extra := ""
+		if isDegraded(r.Context()) {
+			extra = " degraded=true"
+		}
+		if variant := lrw.Header().Get("X-Variant"); variant != "" {
+			extra += " variant=" + variant
+		}
+		if logRoute {
+			extra += " route=" + logValue(r.Pattern)
+		}
+		if cause := cancelCause(r.Context()); cause != "" {
+			extra += " cause=" + cause
+		}
+		accessLog.Printf("level=%s method=%s path=%s status=%d duration=%s request_id=%s req_ct=%s resp_ct=%s%s%s",
+			durationLevel(duration), r.Method, r.URL.Path, lrw.statusCode, duration, reqID, logValue(r.Header.Get("Content-Type")), logValue(lrw.contentType), extra, fields)
+	})
+}
+
+type logFieldsKey struct{}
+
+// logFields collects extra key=value pairs a handler wants on its request's
+// access log line. A handler may hand its context to goroutines, so adds are
+// locked.
+type logFields struct {
+	mu sync.Mutex
+	kv []string
+}
+
+// addLogField attaches key=value to the access log line of the request ctx
+// belongs to. It is a no-op outside loggingMiddleware and in the apache and
+// clf formats, which have no room for extra fields.
+func addLogField(ctx context.Context, key string, value any) {
+	f, ok := ctx.Value(logFieldsKey{}).(*logFields)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	f.kv = append(f.kv, key, logValue(fmt.Sprint(value)))
+	f.mu.Unlock()
+}
+
+// String renders the fields with a leading space, ready to append to a line.
+func (f *logFields) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var b strings.Builder
+	for i := 0; i < len(f.kv); i += 2 {
+		fmt.Fprintf(&b, " %s=%s", f.kv[i], f.kv[i+1])
+	}
+	return b.String()
+}
+
+// durationLevel escalates an access line's level with its duration, so slow
+// successes stand out from fast ones.
+func durationLevel(d time.Duration) string {
+	switch {
+	case d >= verySlowThreshold:
+		return "error"
+	case d >= slowThreshold:
+		return "warn"
+	}
+	return "info"
+}
+
+// maxRequestIDLen caps a caller-supplied X-Request-ID.
+const maxRequestIDLen = 128
+
+// requestID returns the caller-supplied X-Request-ID or generates a new one.
+// A supplied ID is only kept if it is a plain token, so it can go into log
+// lines, the sampling and canary hashes, and the response header as is.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID(id) {
+		return id
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether id is a non-empty run of at most
+// maxRequestIDLen letters, digits and "-_.:". Anything else, such as spaces,
+// quotes or "=", could forge fields in a key=value line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sampleRates holds the access-log sample rate per status class, indexed by
+// status/100. It is built by parseSampleSpec at startup and read-only after.
+var sampleRates = [6]float64{1, 1, 1, 1, 1, 1}
+
+// parseSampleSpec builds sampleRates from a spec like "2xx:0.1,3xx:0.5".
+// Classes not in the spec use defaultRate for 1xx-3xx. 4xx and 5xx are always
+// logged, so a spec sampling them below 1 is rejected rather than letting it
+// hide errors.
+func parseSampleSpec(spec string, defaultRate float64) ([6]float64, error) {
+	rates := [6]float64{1, defaultRate, defaultRate, defaultRate, 1, 1}
+	for _, entry := range splitList(spec) {
+		class, rate, ok := strings.Cut(entry, ":")
+		if !ok || len(class) != 3 || class[1:] != "xx" || class[0] < '1' || class[0] > '5' {
+			return rates, fmt.Errorf("invalid sample entry %q: want <1-5>xx:<rate>", entry)
+		}
+		v, err := strconv.ParseFloat(rate, 64)
+		if err != nil || v < 0 || v > 1 {
+			return rates, fmt.Errorf("invalid sample rate in %q: want a number between 0 and 1", entry)
+		}
+		if class[0] >= '4' && v < 1 {
+			return rates, fmt.Errorf("invalid sample rate in %q: 4xx and 5xx responses are always logged", entry)
+		}
+		rates[class[0]-'0'] = v
+	}
+	return rates, nil
+}
+
+// shouldLog applies the access-log sampler. Slow requests are always logged;
+// everything else is kept with its status class's rate, decided by a hash of
+// the request ID so the same ID always gets the same verdict.
+func shouldLog(reqID string, status int, duration time.Duration) bool {
+	if duration >= slowThreshold {
+		return true
+	}
+	rate := 1.0
+	if class := status / 100; class >= 1 && class < len(sampleRates) {
+		rate = sampleRates[class]
+	}
+	if rate >= 1 {
+		return true
+	}
+	return sampled(reqID, rate)
+}
+
+// sampled reports whether key falls in the first rate of the hash space. FNV
+// barely moves the top bits for keys that differ only at the end, like
+// sequential request IDs, so the sum goes through the splitmix64 finalizer
+// before it is compared.
+func sampled(key string, rate float64) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x)/math.MaxUint64 < rate
+}
+
+// combinedLogLine renders a request in the Apache Combined Log Format:
+// the Common Log Format line followed by "referer" "user-agent".
+func combinedLogLine(r *http.Request, lrw *loggingResponseWriter, start time.Time) string {
+	return fmt.Sprintf("%s %q %q", commonLogLine(r, lrw, start), orDash(r.Referer()), orDash(r.UserAgent()))
+}
+
+// commonLogLine renders a request in the Common Log Format:
+// host ident authuser [date] "request" status bytes.
+func commonLogLine(r *http.Request, lrw *loggingResponseWriter, start time.Time) string {
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	bytes := "-"
+	if lrw.bytesWritten > 0 {
+		bytes = fmt.Sprint(lrw.bytesWritten)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		clientIP(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.RequestURI, r.Proto, lrw.statusCode, bytes)
+}
+
+// trustedProxies are the peers whose X-Forwarded-For header clientIP
+// believes. Empty means the header is ignored, since any client can send it.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare
+// addresses.
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, entry := range splitList(spec) {
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: want a CIDR or IP address", entry)
+		}
+		out = append(out, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+	}
+	return out, nil
+}
+
+func isTrustedProxy(a netip.Addr) bool {
+	for _, p := range trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHost extracts the address from an IPv4 or IPv6 host, with or without
+// a port ("192.0.2.1", "[2001:db8::1]:443", "2001:db8::1"). IPv4-mapped IPv6
+// addresses are unmapped so they match IPv4 prefixes and log as IPv4.
+func parseHost(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if a, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return a.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// clientIP returns the address of the client behind the request. That is the
+// remote address unless the peer is a trusted proxy, in which case
+// X-Forwarded-For is walked from the right, skipping further trusted hops, to
+// the first address a trusted proxy vouched for. Unparseable entries stop the
+// walk, falling back to the last good hop.
+func clientIP(r *http.Request) string {
+	peer, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	if !isTrustedProxy(peer) {
+		return peer.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if strings.TrimSpace(hops[i]) == "" {
+			continue
+		}
+		a, ok := parseHost(hops[i])
+		if !ok {
+			break
+		}
+		client = a
+		if !isTrustedProxy(a) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// logValue renders s for a key=value log line, quoting it if it contains spaces.
+func logValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	if strings.ContainsAny(s, " \t\"") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+	writes       int // successful Write calls; one per frame for streaming handlers
+	wroteHeader  bool
+	contentType  string
+	writeErr     error // first Write or Flush failure, usually a vanished client
+	hijacked     bool
+}
+
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	if lrw.hijacked {
+		return
+	}
+	if !lrw.wroteHeader {
+		lrw.wroteHeader = true
+		lrw.contentType = lrw.Header().Get("Content-Type")
+	}
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
+
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lrw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !lrw.wroteHeader {
+		lrw.wroteHeader = true
+		lrw.contentType = lrw.Header().Get("Content-Type")
+		if lrw.contentType == "" {
+			// Mirror the sniffing net/http does for an unset Content-Type.
+			lrw.contentType = http.DetectContentType(b)
+		}
+	}
+	if lrw.writeErr != nil {
+		// The connection is already dead; fail fast so streaming loops stop.
+		return 0, lrw.writeErr
+	}
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.bytesWritten += int64(n)
+	if err != nil {
+		lrw.writeErr = err
+		return n, err
+	}
+	lrw.writes++
+	return n, nil
+}
+
+// Flush forwards to the underlying writer so streaming handlers still work
+// behind the middleware. A failed flush marks the connection dead like a
+// failed Write.
+func (lrw *loggingResponseWriter) Flush() {
+	if lrw.writeErr != nil {
+		return
+	}
+	if err := http.NewResponseController(lrw.ResponseWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		lrw.writeErr = err
+	}
+}
+
+// Hijack hands the connection to the handler. The handler now writes its own
+// status line, so the access log records the 101 such handlers answer with,
+// and later WriteHeader or Write calls are dropped rather than logged as a
+// client disconnect.
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(lrw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	lrw.hijacked = true
+	lrw.wroteHeader = true
+	lrw.statusCode = http.StatusSwitchingProtocols
+	return conn, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
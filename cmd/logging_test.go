@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPipelinedRequestsAnswerInOrder(t *testing.T) {
+	logs := captureLogs(t)
+	ts := httptest.NewServer(newHandler(newTestServer(t)))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ids := []string{"pipe-1", "pipe-2", "pipe-3"}
+	paths := []string{"/slow?delay=20ms", "/", "/deadline"}
+	var reqs strings.Builder
+	for i, id := range ids {
+		reqs.WriteString("GET " + paths[i] + " HTTP/1.1\r\nHost: test\r\nX-Request-ID: " + id + "\r\n\r\n")
+	}
+	// All three are written before any response is read.
+	if _, err := io.WriteString(conn, reqs.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	for i, id := range ids {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Request-ID"); got != id {
+			t.Errorf("response %d has X-Request-ID %q, want %q", i, got, id)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("response %d: status %d, body %s", i, resp.StatusCode, body)
+		}
+	}
+	// Each access line must pair a request's ID with its own path.
+	for i, id := range ids {
+		path, _, _ := strings.Cut(paths[i], "?")
+		if line := logLine(logs.String(), "request_id="+id); !strings.Contains(line, " path="+path+" ") {
+			t.Errorf("access line for %s = %q, want path=%s", id, line, path)
+		}
+	}
+}
+
+func TestUnsafeRequestIDIsReplaced(t *testing.T) {
+	logs := captureLogs(t)
+	h := newHandler(newTestServer(t))
+	for _, id := range []string{`x status=200 forged="1"`, `a"b`, "a=b", strings.Repeat("a", maxRequestIDLen+1)} {
+		rec := serve(h, "GET", "/", nil, "X-Request-ID", id)
+		got := rec.Header().Get("X-Request-ID")
+		if got == id || !validRequestID(got) {
+			t.Errorf("X-Request-ID %q came back as %q, want a generated ID", id, got)
+		}
+	}
+	if strings.Contains(logs.String(), "forged") {
+		t.Errorf("a supplied ID reached the log:\n%s", logs)
+	}
+	if got := serve(h, "GET", "/", nil, "X-Request-ID", "trace-1:a_b.c").Header().Get("X-Request-ID"); got != "trace-1:a_b.c" {
+		t.Errorf("token ID came back as %q, want it kept", got)
+	}
+}
+
+func TestSamplingIsEvenForSequentialIDs(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.2, 0.5} {
+		const n = 2000
+		hits := 0
+		for i := range n {
+			if sampled(fmt.Sprintf("req-%d", i), rate) {
+				hits++
+			}
+		}
+		if got := float64(hits) / n; got < rate-0.04 || got > rate+0.04 {
+			t.Errorf("rate %g sampled %.3f of sequential IDs", rate, got)
+		}
+	}
+	if sampled("same", 0.5) != sampled("same", 0.5) {
+		t.Error("sampling is not deterministic")
+	}
+}
+
+// combinedLogRE matches an Apache Combined Log Format line.
+var combinedLogRE = regexp.MustCompile(`^\S+ - \S+ \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "[A-Z]+ \S+ HTTP/\d\.\d" \d{3} (\d+|-) "[^"]*" "[^"]*"$`)
+
+func TestApacheLogLineMatchesCombinedFormat(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &logFormat, "apache")
+	h := newHandler(newTestServer(t))
+	serve(h, "GET", "/?q=1", nil, "Referer", "http://example.com/", "User-Agent", "test-agent/1.0")
+
+	line := logLine(logs.String(), `"GET /?q=1 HTTP/1.1"`)
+	if !combinedLogRE.MatchString(line) {
+		t.Fatalf("line %q is not in Combined Log Format", line)
+	}
+	if !strings.HasSuffix(line, ` 200 `+strconv.Itoa(len(`{"message":"demo service"}`)+1)+` "http://example.com/" "test-agent/1.0"`) {
+		t.Errorf("line %q lacks status, size, referer or user agent", line)
+	}
+}
+
+func TestSamplerKeepsItsFractionAndEveryError(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowThreshold, time.Hour)
+	rates, err := parseSampleSpec("", 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &sampleRates, rates)
+	h := newHandler(newTestServer(t))
+
+	const n = 800
+	for i := range n {
+		serve(h, "GET", "/", nil, "X-Request-ID", fmt.Sprintf("ok-%d", i))
+		serve(h, "GET", "/migrate", nil, "X-Request-ID", fmt.Sprintf("err-%d", i))
+	}
+	out := logs.String()
+	oks, errs := strings.Count(out, " path=/ status=200 "), strings.Count(out, " path=/migrate status=500 ")
+	if got := float64(oks) / n; got < 0.2 || got > 0.3 {
+		t.Errorf("logged %d of %d successes, want about 25%%", oks, n)
+	}
+	if errs != n {
+		t.Errorf("logged %d of %d errors, want all", errs, n)
+	}
+	// The verdict is a function of the request ID alone.
+	before := strings.Count(logs.String(), "request_id=ok-7 ")
+	serve(h, "GET", "/", nil, "X-Request-ID", "ok-7")
+	if after := strings.Count(logs.String(), "request_id=ok-7 "); after != 2*before {
+		t.Errorf("replaying ok-7 changed its sampling verdict (%d then %d lines)", before, after)
+	}
+}
+
+func TestClosedLogPipeKeepsServing(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Close()
+	defer pw.Close()
+	fallback := &syncBuffer{}
+	out := &safeWriter{primary: pw, fallback: fallback}
+	log.SetOutput(out)
+	accessLog.SetOutput(out)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		accessLog.SetOutput(os.Stdout)
+	})
+
+	h := newHandler(newTestServer(t))
+	for i := range 3 {
+		if rec := serve(h, "GET", "/", nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d after the pipe closed: %d", i, rec.Code)
+		}
+	}
+	if !strings.Contains(fallback.String(), `msg="log output failed, using fallback"`) || strings.Count(fallback.String(), " path=/ status=200 ") != 3 {
+		t.Errorf("fallback did not take over the log:\n%s", fallback)
+	}
+
+	dropped := &safeWriter{primary: pw}
+	if n, err := dropped.Write([]byte("line\n")); n != 5 || err != nil || dropped.dropped != 1 {
+		t.Errorf("without a fallback Write = %d, %v with %d dropped, want the line dropped silently", n, err, dropped.dropped)
+	}
+}
+
+func TestAccessLogRecordsContentTypes(t *testing.T) {
+	logs := captureLogs(t)
+	h := newHandler(newTestServer(t))
+	serve(h, "POST", "/json-demo", strings.NewReader(`{"a":1}`), "Content-Type", "application/json", "X-Request-ID", "ct-json")
+	// There is no XML route; a rejected XML request still logs both sides.
+	serve(h, "GET", "/json-demo", strings.NewReader(`<a>1</a>`), "Content-Type", "application/xml", "X-Request-ID", "ct-xml")
+
+	for id, want := range map[string]string{
+		"ct-json": "req_ct=application/json resp_ct=application/json",
+		"ct-xml":  `req_ct=application/xml resp_ct="text/plain; charset=utf-8"`,
+	} {
+		if line := logLine(logs.String(), "request_id="+id); !strings.Contains(line, want) {
+			t.Errorf("access line %q lacks %s", line, want)
+		}
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestTeeWritesEveryDestination(t *testing.T) {
+	f, err := openLogFile(filepath.Join(t.TempDir(), "demo.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	l := log.New(&teeWriter{dsts: []io.Writer{&buf, failingWriter{}, f}}, "", 0)
+	l.Print(`level=info msg="teed"`)
+
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "level=info msg=\"teed\"\n"
+	if buf.String() != want || string(got) != want {
+		t.Errorf("buffer %q, file %q, want both %q", buf.String(), got, want)
+	}
+}
+
+func TestSampleSpecRatesEachStatusClass(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowThreshold, time.Hour)
+	rates, err := parseSampleSpec("2xx:0.1,5xx:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates[5] != 1 || rates[4] != 1 || rates[3] != 1 {
+		t.Fatalf("rates = %v", rates)
+	}
+	if def, _ := parseSampleSpec("2xx:0.1", 0); def[5] != 1 || def[4] != 1 || def[3] != 0 {
+		t.Errorf("defaults = %v, want 4xx and 5xx at 1 and the default rate elsewhere", def)
+	}
+	setForTest(t, &sampleRates, rates)
+	h := newHandler(newTestServer(t))
+
+	const n = 1000
+	for i := range n {
+		serve(h, "GET", "/", nil, "X-Request-ID", fmt.Sprintf("class-%d", i))
+		serve(h, "GET", "/migrate", nil, "X-Request-ID", fmt.Sprintf("class-err-%d", i))
+	}
+	oks, errs := strings.Count(logs.String(), " status=200 "), strings.Count(logs.String(), " status=500 ")
+	if oks < n*6/100 || oks > n*14/100 {
+		t.Errorf("logged %d of %d 2xx responses, want about 10%%", oks, n)
+	}
+	if errs != n {
+		t.Errorf("logged %d of %d 5xx responses, want all", errs, n)
+	}
+	for _, bad := range []string{"2xx", "6xx:1", "2xx:2", "200:0.5", "5xx:0.1", "4xx:0.5"} {
+		if _, err := parseSampleSpec(bad, 1); err == nil {
+			t.Errorf("spec %q accepted", bad)
+		}
+	}
+}
+
+// dyingWriter accepts frames writes, then fails like a vanished client.
+type dyingWriter struct {
+	*httptest.ResponseRecorder
+	frames int
+}
+
+func (w *dyingWriter) Write(b []byte) (int, error) {
+	if w.frames == 0 {
+		return 0, syscall.EPIPE
+	}
+	w.frames--
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamStopsWhenTheClientDisconnects(t *testing.T) {
+	logs := captureLogs(t)
+	attempts := 0
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 100 {
+			attempts++
+			if _, err := io.WriteString(w, "frame\n"); err != nil {
+				return
+			}
+			http.NewResponseController(w).Flush()
+		}
+	}))
+	w := &dyingWriter{ResponseRecorder: httptest.NewRecorder(), frames: 3}
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+
+	if attempts != 4 {
+		t.Errorf("handler attempted %d writes, want it to stop at the first failure (4)", attempts)
+	}
+	line := logLine(logs.String(), `msg="client disconnected"`)
+	if !strings.Contains(line, "path=/stream") || !strings.Contains(line, " writes=3 bytes=18 ") {
+		t.Errorf("disconnect line = %q, want path=/stream writes=3 bytes=18", line)
+	}
+}
+
+// commonLogRE matches a Common Log Format line.
+var commonLogRE = regexp.MustCompile(`^\S+ - \S+ \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "[A-Z]+ \S+ HTTP/\d\.\d" \d{3} (\d+|-)$`)
+
+func TestCommonLogFormatToAccessLogFile(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &logFormat, "clf")
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := setupLogOutput("", "", path); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(logs) // keep app lines out of the test output
+	h := newHandler(newTestServer(t))
+	r := httptest.NewRequest("GET", "/deadline", nil)
+	r.SetBasicAuth("ada", "pw")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSuffix(string(data), "\n")
+	if !commonLogRE.MatchString(line) || !strings.HasPrefix(line, "192.0.2.1 - ada [") || !strings.Contains(line, `"GET /deadline HTTP/1.1" 200 `) {
+		t.Errorf("access log = %q, want one CLF line for ada's GET /deadline", data)
+	}
+	if strings.Contains(logs.String(), "/deadline HTTP/1.1") {
+		t.Errorf("access line also reached the app log:\n%s", logs)
+	}
+}
+
+func TestSlowRequestsEscalateLogLevel(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowThreshold, 20*time.Millisecond)
+	setForTest(t, &verySlowThreshold, 80*time.Millisecond)
+	h := newHandler(newTestServer(t))
+	for id, delay := range map[string]string{"fast": "0s", "slow": "30ms", "very-slow": "100ms"} {
+		serve(h, "GET", "/slow?delay="+delay, nil, "X-Request-ID", id)
+	}
+	for id, level := range map[string]string{"fast": "info", "slow": "warn", "very-slow": "error"} {
+		if line := logLine(logs.String(), "request_id="+id+" "); !strings.Contains(line, "level="+level+" method=GET") {
+			t.Errorf("%s request logged as %q, want level=%s", id, line, level)
+		}
+	}
+}
+
+func TestHandlerFieldsReachTheAccessLine(t *testing.T) {
+	logs := captureLogs(t)
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addLogField(r.Context(), "versions_applied", 2)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			addLogField(r.Context(), "note", "two words")
+		}()
+		<-done
+	}))
+	serve(h, "POST", "/migrate", nil, "X-Request-ID", "fields-1")
+	line := logLine(logs.String(), "request_id=fields-1 ")
+	if !strings.HasSuffix(line, ` versions_applied=2 note="two words"`) {
+		t.Errorf("access line = %q, want the handler's fields at the end", line)
+	}
+
+	serve(newHandler(newTestServer(t)), "GET", "/race-demo", nil, "X-Request-ID", "fields-2")
+	if line := logLine(logs.String(), "request_id=fields-2 "); !strings.Contains(line, " lost_updates=0") {
+		t.Errorf("/race-demo access line = %q, want lost_updates=0", line)
+	}
+	// Outside loggingMiddleware there is nowhere for the field to go.
+	addLogField(t.Context(), "ignored", 1)
+}
+
+func TestClientIPHandlesIPv6(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, fd00::/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &trustedProxies, proxies)
+	for _, tc := range []struct{ remote, xff, want string }{
+		{"[::1]:12345", "", "::1"},
+		{"[2001:db8::7]:443", "192.0.2.9", "2001:db8::7"}, // untrusted peer: XFF ignored
+		{"[::ffff:192.0.2.1]:80", "", "192.0.2.1"},
+		{"10.1.2.3:80", "2001:db8::42", "2001:db8::42"},
+		{"[fd00::1]:80", "[2001:db8::42]:5555, 10.0.0.2", "2001:db8::42"},
+		{"[fd00::1]:80", "198.51.100.7, 2001:db8::1, fd00::2", "198.51.100.7"},
+		{"[2001:db8::1]:80", "2001:db8::9, not-an-ip, fd00::3", "fd00::3"},
+		{"[fe80::1%eth0]:80", "", "fe80::1%eth0"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, XFF %q) = %q, want %q", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestAccessLineCarriesTheRoutePattern(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	h := newHandler(newTestServer(t))
+
+	serve(h, "GET", "/items/123", nil, "X-Request-ID", "route-off")
+	if line := logLine(logs.String(), "request_id=route-off "); line == "" || strings.Contains(line, "route=") {
+		t.Errorf("without -log-route: %q", line)
+	}
+
+	setForTest(t, &logRoute, true)
+	for _, tc := range []struct{ method, target, id, path, route string }{
+		{"GET", "/items/123", "route-1", "/items/123", "/"},
+		{"GET", "/slow?delay=0s", "route-2", "/slow", "/slow"},
+		{"POST", "/warmup", "route-3", "/warmup", `"POST /warmup"`},
+	} {
+		serve(h, tc.method, tc.target, nil, "X-Request-ID", tc.id, "Authorization", "Bearer secret")
+		line := logLine(logs.String(), "request_id="+tc.id+" ")
+		if !strings.Contains(line, " path="+tc.path+" ") || !strings.Contains(line+" ", " route="+tc.route+" ") {
+			t.Errorf("%s %s: line %q, want path=%s route=%s", tc.method, tc.target, line, tc.path, tc.route)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// metricsLogInterval is how often metricsLogLoop logs a metrics snapshot;
+// 0 disables it.
+var metricsLogInterval time.Duration
+
+// maxLatencySamples bounds how many request durations one interval keeps
+// for the p99; requests beyond it still count towards the rates.
+const maxLatencySamples = 10000
+
+// latencyWindow collects the status and duration of logged requests between
+// two metrics snapshots.
+type latencyWindow struct {
+	mu        sync.Mutex
+	samples   []time.Duration
+	requests  int64
+	errors    int64 // responses with a 5xx status
+	truncated bool
+}
+
+var latencies latencyWindow
+
+// observe records one finished request. It is a no-op unless the metrics
+// log is enabled.
+func (lw *latencyWindow) observe(status int, d time.Duration) {
+	if metricsLogInterval <= 0 {
+		return
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.requests++
+	if status >= 500 {
+		lw.errors++
+	}
+	if len(lw.samples) < maxLatencySamples {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.truncated = true
+	}
+}
+
+// reset returns what was collected since the last call and starts afresh.
+func (lw *latencyWindow) reset() (samples []time.Duration, requests, errors int64, truncated bool) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	samples, requests, errors, truncated = lw.samples, lw.requests, lw.errors, lw.truncated
+	lw.samples, lw.requests, lw.errors, lw.truncated = nil, 0, 0, false
+	return
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of ds by the
+// nearest-rank method, sorting ds in place. It returns 0 for no samples.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	slices.Sort(ds)
+	i := int(float64(len(ds))*p+0.5) - 1
+	return ds[min(max(i, 0), len(ds)-1)]
+}
+
+// metricsLogLoop logs a summary of the last interval every
+// metricsLogInterval until ctx is cancelled. Counts, rates and p99 cover only
+// the logged requests of that interval, so req_rate and error_rate share a
+// denominator; in-flight and the DB pool are read at the moment of logging.
+func (s *server) metricsLogLoop(ctx context.Context) {
+	t := time.NewTicker(metricsLogInterval)
+	defer t.Stop()
+	last := time.Now()
+	latencies.reset()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			elapsed := now.Sub(last).Seconds()
+			samples, logged, errs, truncated := latencies.reset()
+			errRate := 0.0
+			if logged > 0 {
+				errRate = float64(errs) / float64(logged)
+			}
+			pool := ""
+			if s.db != nil {
+				ds := s.db.Stats()
+				pool = fmt.Sprintf(" db_open=%d db_in_use=%d db_idle=%d db_wait_count=%d", ds.OpenConnections, ds.InUse, ds.Idle, ds.WaitCount)
+			}
+			log.Printf("level=info msg=\"metrics snapshot\" interval=%s requests=%d req_rate=%.2f errors=%d error_rate=%.4f p99=%s p99_truncated=%t in_flight=%d%s",
+				metricsLogInterval, logged, float64(logged)/elapsed, errs, errRate,
+				percentile(samples, 0.99), truncated, stats.inFlight.Load(), pool)
+			last = now
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsSnapshotCountsLoggedRequests(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &metricsLogInterval, 200*time.Millisecond)
+	s := newTestServer(t)
+	h := newHandler(s)
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.metricsLogLoop(ctx)
+	}()
+	defer func() { cancel(); <-done }()
+	time.Sleep(10 * time.Millisecond) // let the loop start its first window
+
+	for range 3 {
+		serve(h, "GET", "/", nil)
+	}
+	serve(h, "GET", "/migrate", nil) // 500
+	serve(h, "GET", "/ping", nil)    // not logged, so not counted
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if line := logLine(logs.String(), `msg="metrics snapshot"`); line != "" {
+			for _, want := range []string{"requests=4 ", "errors=1 ", "error_rate=0.2500 "} {
+				if !strings.Contains(line, want) {
+					t.Errorf("snapshot lacks %q: %s", want, line)
+				}
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no metrics snapshot logged:\n%s", logs)
+}
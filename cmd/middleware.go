@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	corsOrigins    []string
+	corsMaxAge     int
+	pathRules      []pathRule
+	maxHeaderBytes = http.DefaultMaxHeaderBytes
+	requestTimeout = 30 * time.Second
+	maxURILength   = 8 << 10
+)
+
+// loggedURIPrefix is how much of an over-long URI is kept in the log line.
+const loggedURIPrefix = 64
+
+// pathRule rejects request paths matching a known-bad pattern.
+type pathRule struct {
+	name  string
+	match func(path string) bool
+}
+
+// knownPathRules are the rules selectable with -path-rules.
+var knownPathRules = map[string]pathRule{
+	"dotdot": {"dotdot", func(p string) bool { return strings.Contains(p, "..") }},
+	"null":   {"null", func(p string) bool { return strings.IndexByte(p, 0) >= 0 }},
+	"ctrl": {"ctrl", func(p string) bool {
+		return strings.IndexFunc(p, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0
+	}},
+}
+
+// parsePathRules resolves a comma-separated list of rule names.
+func parsePathRules(spec string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, name := range splitList(spec) {
+		rule, ok := knownPathRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown path rule %q", name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// pathGuardMiddleware rejects requests whose path trips one of pathRules with
+// a 400. It must wrap the mux, which would otherwise clean ".." segments into
+// a redirect before the guard sees them.
+func pathGuardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range pathRules {
+			if rule.match(r.URL.Path) || rule.match(r.URL.RawPath) {
+				log.Printf("level=warn msg=\"rejected suspicious path\" rule=%s path=%q", rule.name, r.URL.Path)
+				http.Error(w, "bad request path", http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsMiddleware answers CORS preflights and tags responses for allowed
+// origins. It is a no-op unless -cors-origins is set.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !slices.Contains(corsOrigins, "*") && !slices.Contains(corsOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Preflight: answer directly and let the browser cache the verdict.
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+			w.Header().Set("Access-Control-Allow-Headers", h)
+		}
+		if corsMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// headerLimitMiddleware answers 431 when the request line and headers exceed
+// maxHeaderBytes. http.Server enforces the same limit (as MaxHeaderBytes) with
+// 4 KiB of slack, but it writes its own 431 before any handler runs, so that
+// rejection never reaches the access log; this catches oversized requests
+// within the slack so they are logged.
+func headerLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := headerSize(r); n > maxHeaderBytes {
+			log.Printf("level=warn msg=\"request headers too large\" path=%s header_bytes=%d limit=%d", r.URL.Path, n, maxHeaderBytes)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerSize approximates the wire size of the request line and headers.
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	n += len("Host: ") + len(r.Host) + 2
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// uriLimitMiddleware answers 414 for request URIs longer than maxURILength.
+// It is the outermost middleware, ahead of everything that logs or counts,
+// so an enormous URI only ever reaches the log as a short prefix.
+func uriLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(r.RequestURI); maxURILength > 0 && n > maxURILength {
+			log.Printf("level=warn msg=\"request uri too long\" uri_prefix=%q uri_bytes=%d limit=%d",
+				r.RequestURI[:min(n, loggedURIPrefix)], n, maxURILength)
+			http.Error(w, "request URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware puts a deadline on each request's context: the route's
+// entry in routeTimeouts, else requestTimeout. It runs inside
+// trailingSlashMiddleware, so a lenient /slow/ is looked up as /slow. The
+// effective timeout is returned in X-Request-Timeout. Handlers that watch
+// ctx.Done() stop when it passes; the response itself is not cut off.
+func timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout := requestTimeout
+		if d, ok := routeTimeouts[r.URL.Path]; ok {
+			timeout = d
+		}
+		w.Header().Set("X-Request-Timeout", timeout.String())
+		ctx, cancel := context.WithTimeoutCause(r.Context(), timeout, errServerTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// errServerTimeout is the cause timeoutMiddleware gives its deadline, so a
+// server timeout can be told apart from any other end of the context.
+var errServerTimeout = errors.New("server timeout")
+
+// cancelCause names why ctx ended: "server_timeout" when timeoutMiddleware's
+// deadline fired, "client_cancel" when the client went away, or
+// "deadline_exceeded" for any other deadline. It returns "" while ctx is live.
+func cancelCause(ctx context.Context) string {
+	switch {
+	case ctx.Err() == nil:
+		return ""
+	case errors.Is(context.Cause(ctx), errServerTimeout):
+		return "server_timeout"
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "client_cancel"
+	default:
+		return "deadline_exceeded"
+	}
+}
+
+// parseRouteTimeouts applies a -route-timeout spec, comma-separated
+// /path:duration entries, on top of the defaults in routeTimeouts.
+func parseRouteTimeouts(spec string) error {
+	for _, entry := range splitList(spec) {
+		i := strings.LastIndex(entry, ":")
+		if i < 0 || !strings.HasPrefix(entry, "/") {
+			return fmt.Errorf("invalid route timeout %q: want /path:duration", entry)
+		}
+		d, err := time.ParseDuration(entry[i+1:])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration in %q: want a positive duration", entry)
+		}
+		routeTimeouts[entry[:i]] = d
+	}
+	return nil
+}
+
+// remaining reports how long ctx has before its deadline, so handlers can
+// skip work they can't finish. Without a deadline it returns the maximum
+// duration.
+func remaining(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return math.MaxInt64
+	}
+	return time.Until(deadline)
+}
+
+// trailingSlash selects how a trailing slash on a registered route is
+// handled: strict (404), redirect (301 to the path without it) or lenient
+// (served as if it were absent).
+var trailingSlash = "strict"
+
+// trailingSlashMiddleware applies trailingSlash to requests like /health/
+// whose path minus the slash names a route on mux. Without it they would fall
+// through to the catch-all "/" route. It runs ahead of next, the rest of the
+// chain down to mux, so in lenient mode the rate limiter and timeout see the
+// trimmed path too. Other paths go to next unchanged.
+func trailingSlashMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := trimTrailingSlash(mux, r)
+		if r2 == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch trailingSlash {
+		case "redirect":
+			u := *r2.URL
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		case "lenient":
+			next.ServeHTTP(w, r2)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// trimTrailingSlash returns a copy of r without the trailing slashes on its
+// path if that names a route on mux other than the catch-all "/", and nil
+// when trailingSlash does not apply to r.
+func trimTrailingSlash(mux *http.ServeMux, r *http.Request) *http.Request {
+	path := r.URL.Path
+	if len(path) < 2 || !strings.HasSuffix(path, "/") {
+		return nil
+	}
+	trimmed := strings.TrimRight(path, "/")
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = trimmed, ""
+	if _, pattern := mux.Handler(r2); trimmed == "" || pattern == "" || pattern == "/" {
+		return nil
+	}
+	return r2
+}
+
+// responseHeaders are added to every response by responseHeaderMiddleware.
+var responseHeaders = http.Header{}
+
+// parseResponseHeader adds one -response-headers value, "Name: value", to
+// responseHeaders. Names must be valid header tokens and values may not
+// contain line breaks, so a typo fails at startup rather than on the wire.
+func parseResponseHeader(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" {
+		return fmt.Errorf("%q: want Name: value", s)
+	}
+	for _, c := range name {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return fmt.Errorf("%q: invalid character %q in header name", s, c)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("%q: header value contains a line break or NUL", s)
+	}
+	responseHeaders.Add(name, value)
+	return nil
+}
+
+// responseHeaderMiddleware sets the operator's -response-headers before the
+// handler runs, so a handler that sets the same header replaces the
+// configured value rather than being overridden by it.
+func responseHeaderMiddleware(next http.Handler) http.Handler {
+	if len(responseHeaders) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for name, values := range responseHeaders {
+			h[name] = slices.Clone(values)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrailingSlashModes(t *testing.T) {
+	captureLogs(t)
+	for _, tc := range []struct {
+		mode       string
+		wantStatus int
+		wantLoc    string
+	}{
+		{"strict", http.StatusNotFound, ""},
+		{"redirect", http.StatusMovedPermanently, "/health?verbose=1"},
+		{"lenient", http.StatusOK, ""},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			setForTest(t, &trailingSlash, tc.mode)
+			h := newHandler(newTestServer(t))
+			rec := serve(h, "GET", "/health/?verbose=1", nil)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d; body %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if loc := rec.Header().Get("Location"); loc != tc.wantLoc {
+				t.Errorf("Location = %q, want %q", loc, tc.wantLoc)
+			}
+			if rec := serve(h, "GET", "/health", nil); rec.Code != http.StatusOK {
+				t.Errorf("/health without the slash: status %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestLenientSlashKeepsRouteRateLimit(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &trailingSlash, "lenient")
+	h := limitedHandler(t, "/migrate:1:1", 0, 0)
+	if got := statuses(h, "POST", "/migrate", 1); got[0] == http.StatusTooManyRequests {
+		t.Fatalf("first /migrate throttled")
+	}
+	if got := statuses(h, "POST", "/migrate/", 2); got[0] != http.StatusTooManyRequests || got[1] != http.StatusTooManyRequests {
+		t.Errorf("/migrate/ statuses = %v, want 429s from the /migrate bucket", got)
+	}
+}
+
+func TestRoutesGetTheirOwnTimeouts(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &trailingSlash, "lenient")
+	h := newHandler(newTestServer(t))
+	for path, want := range map[string]string{
+		"/":                "1s",
+		"/slow?delay=1ms":  "10s",
+		"/slow/?delay=1ms": "10s", // normalized before the lookup
+		"/migrate":         "30s",
+		"/deadline":        requestTimeout.String(),
+	} {
+		if got := serve(h, "GET", path, nil).Header().Get("X-Request-Timeout"); got != want {
+			t.Errorf("%s: X-Request-Timeout = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRouteTimeoutIsEnforced(t *testing.T) {
+	captureLogs(t)
+	timeouts := maps.Clone(routeTimeouts)
+	t.Cleanup(func() { routeTimeouts = timeouts })
+	if err := parseRouteTimeouts("/slow:50ms"); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newTestServer(t))
+	// Within its own budget /slow refuses a delay it can't finish.
+	if rec := serve(h, "GET", "/slow?delay=200ms", nil); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("/slow with a 50ms timeout: status %d, want 504", rec.Code)
+	}
+	if rec := serve(h, "GET", "/slow?delay=10ms", nil); rec.Code != http.StatusOK {
+		t.Errorf("/slow?delay=10ms: status %d, want 200", rec.Code)
+	}
+	if got := serve(h, "GET", "/deadline", nil).Body.String(); !strings.Contains(got, `"has_deadline":true`) {
+		t.Errorf("/deadline got no deadline: %s", got)
+	}
+}
+
+func TestOversizedHeadersAreRejectedAndLogged(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &maxHeaderBytes, 1024)
+	h := newHandler(newTestServer(t))
+
+	rec := serve(h, "GET", "/", nil, "X-Padding", strings.Repeat("a", 2048))
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge || rec.Header().Get("Connection") != "close" {
+		t.Fatalf("got %d Connection=%q, want 431 close", rec.Code, rec.Header().Get("Connection"))
+	}
+	if !strings.Contains(logs.String(), `msg="request headers too large" path=/`) {
+		t.Errorf("oversized request not logged:\n%s", logs)
+	}
+	if rec := serve(h, "GET", "/", nil, "X-Padding", "small"); rec.Code != http.StatusOK {
+		t.Errorf("small headers got %d, want 200", rec.Code)
+	}
+}
+
+func TestPreflightCarriesMaxAge(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &corsOrigins, []string{"https://app.example"})
+	setForTest(t, &corsMaxAge, 600)
+	h := newHandler(newTestServer(t))
+
+	rec := serve(h, "OPTIONS", "/json-demo", nil, "Origin", "https://app.example", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "Content-Type")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight = %d, want 204", rec.Code)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Max-Age":       "600",
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Headers": "Content-Type",
+	} {
+		if got := rec.Header().Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+	other := serve(h, "OPTIONS", "/json-demo", nil, "Origin", "https://evil.example", "Access-Control-Request-Method", "POST")
+	if other.Header().Get("Access-Control-Max-Age") != "" || other.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("disallowed origin got CORS headers: %v", other.Header())
+	}
+}
+
+func TestPathGuard(t *testing.T) {
+	logs := captureLogs(t)
+	rules, err := parsePathRules("dotdot,null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &pathRules, rules)
+	h := newHandler(newTestServer(t))
+
+	for target, want := range map[string]int{
+		"/static/../etc/passwd":   http.StatusBadRequest,
+		"/static/%2e%2e/passwd":   http.StatusBadRequest,
+		"/a%00b":                  http.StatusBadRequest,
+		"/deadline":               http.StatusOK,
+		"/deadline?next=../other": http.StatusOK, // only the path is checked
+	} {
+		if rec := serve(h, "GET", target, nil); rec.Code != want {
+			t.Errorf("%s = %d, want %d", target, rec.Code, want)
+		}
+	}
+	if !strings.Contains(logs.String(), `msg="rejected suspicious path" rule=dotdot`) {
+		t.Errorf("rejection not logged:\n%s", logs)
+	}
+	if _, err := parsePathRules("dotdot,bogus"); err == nil {
+		t.Error("unknown rule accepted")
+	}
+}
+
+func TestOverlongURIIsRejectedWithoutLoggingIt(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &maxURILength, 256)
+	// Debug mode's allocation log names the path of every sampled request.
+	setDebugForTest(t, true)
+	setForTest(t, &allocSampleRate, 1.0)
+	h := newHandler(newTestServer(t))
+
+	tail := strings.Repeat("x", 300) + "SECRET-TAIL"
+	rec := serve(h, "GET", "/"+tail+"?q="+tail, nil)
+	if rec.Code != http.StatusRequestURITooLong {
+		t.Fatalf("long URI = %d, want 414", rec.Code)
+	}
+	line := logLine(logs.String(), `msg="request uri too long"`)
+	if !strings.Contains(line, "uri_bytes=626 limit=256") {
+		t.Errorf("rejection line = %q", line)
+	}
+	if strings.Contains(logs.String(), "SECRET-TAIL") {
+		t.Errorf("the full URI reached the log:\n%s", logs)
+	}
+	if rec := serve(h, "GET", "/?q=short", nil); rec.Code != http.StatusOK {
+		t.Errorf("short URI = %d, want 200", rec.Code)
+	}
+}
+
+func TestConfiguredResponseHeadersAppear(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &responseHeaders, http.Header{})
+	for _, spec := range []string{"Deprecation: true", "Sunset: Sat, 01 Jan 2028 00:00:00 GMT"} {
+		if err := parseResponseHeader(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newHandler(newTestServer(t))
+	for _, target := range []string{"/", "/livez", "/nope"} {
+		rec := serve(h, "GET", target, nil)
+		if rec.Header().Get("Deprecation") != "true" || rec.Header().Get("Sunset") != "Sat, 01 Jan 2028 00:00:00 GMT" {
+			t.Errorf("%s headers = %v, want Deprecation and Sunset", target, rec.Header())
+		}
+	}
+	for _, bad := range []string{"NoColon", "Bad Name: x", "X-Split: a\r\nInjected: 1"} {
+		if err := parseResponseHeader(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestCancelCauseInTheAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &requestTimeout, 30*time.Millisecond)
+	setForTest(t, &routeTimeouts, map[string]time.Duration{})
+	// A handler that keeps going until its context ends, as /slow would with
+	// a delay longer than the timeout.
+	waiting := timeoutMiddleware(loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusGatewayTimeout)
+	})))
+	serve(waiting, "GET", "/wait", nil, "X-Request-ID", "server-1")
+	if line := logLine(logs.String(), "request_id=server-1 "); !strings.Contains(line, "status=504") || !strings.Contains(line, " cause=server_timeout") {
+		t.Errorf("server timeout logged as %q, want cause=server_timeout", line)
+	}
+
+	setForTest(t, &requestTimeout, 10*time.Second)
+	serveCanceled(newHandler(newTestServer(t)), "/slow?delay=2s", 20*time.Millisecond)
+	if line := logLine(logs.String(), `msg="context canceled"`); !strings.Contains(line, "path=/slow cause=client_cancel") {
+		t.Errorf("/slow handler line = %q, want cause=client_cancel", line)
+	}
+	if line := logLine(logs.String(), "path=/slow status="); !strings.Contains(line, " cause=client_cancel") {
+		t.Errorf("/slow access line = %q, want cause=client_cancel", line)
+	}
+	if line := logLine(logs.String(), "path=/wait"); strings.Contains(line, "client_cancel") {
+		t.Errorf("server timeout mistaken for a client cancel: %q", line)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if got := cancelCause(ctx); got != "deadline_exceeded" {
+		t.Errorf("cancelCause(foreign deadline) = %q, want deadline_exceeded", got)
+	}
+	if got := cancelCause(context.Background()); got != "" {
+		t.Errorf("cancelCause(live ctx) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// migration is a versioned schema change applied at most once per database.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations is the schema history. Never edit an entry once it has shipped:
+// applyMigrations records a checksum of each SQL body and refuses to run if
+// an applied migration no longer matches it.
+var migrations = []migration{
+	{1, "create_users", "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL)"},
+	{2, "add_users_email", "ALTER TABLE users ADD COLUMN email TEXT"},
+}
+
+// errMigrationDrift reports that an applied migration's SQL has since changed.
+var errMigrationDrift = errors.New("migration drift")
+
+const (
+	// migrationLockWait is how long applyMigrations waits for another
+	// instance to finish migrating before giving up.
+	migrationLockWait = 10 * time.Second
+	// migrationLockStale is the age after which a held lock is assumed to
+	// belong to an instance that died mid-migration and is taken over.
+	migrationLockStale = time.Minute
+	migrationLockPoll  = 100 * time.Millisecond
+)
+
+// errMigrationLocked reports that another instance held the migration lock
+// for longer than migrationLockWait.
+var errMigrationLocked = errors.New("migration lock held by another instance")
+
+// migrationLockOwner identifies this process in migration_lock.
+var migrationLockOwner = hostname() + ":" + strconv.Itoa(os.Getpid())
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+// acquireMigrationLock takes the single-row advisory lock in migration_lock,
+// polling while another owner holds it. A lock older than migrationLockStale
+// is deleted and retaken so a crashed instance can't block migrations forever.
+// It gives up when ctx ends. The returned func releases the lock.
+func acquireMigrationLock(ctx context.Context, db *sql.DB, owner string) (func(), error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS migration_lock (
+		id          INTEGER PRIMARY KEY CHECK (id = 1),
+		owner       TEXT NOT NULL,
+		acquired_at TEXT NOT NULL
+	)`); err != nil {
+		return nil, fmt.Errorf("create migration_lock: %w", err)
+	}
+
+	deadline := time.Now().Add(migrationLockWait)
+	for waited := false; ; waited = true {
+		now := time.Now().UTC()
+		stale := now.Add(-migrationLockStale).Format(time.RFC3339)
+		if res, err := db.ExecContext(ctx, "DELETE FROM migration_lock WHERE id = 1 AND acquired_at < ?", stale); err != nil {
+			return nil, fmt.Errorf("clear stale migration lock: %w", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("level=warn msg=\"took over stale migration lock\" owner=%s stale_after=%s", owner, migrationLockStale)
+		}
+
+		res, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO migration_lock (id, owner, acquired_at) VALUES (1, ?, ?)",
+			owner, now.Format(time.RFC3339))
+		if err != nil {
+			return nil, fmt.Errorf("acquire migration lock: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			// Released even if ctx has ended, so the lock doesn't go stale.
+			return func() {
+				if _, err := db.Exec("DELETE FROM migration_lock WHERE id = 1 AND owner = ?", owner); err != nil {
+					log.Printf("level=error msg=\"release migration lock failed\" owner=%s err=%v", owner, err)
+				}
+			}, nil
+		}
+
+		if !waited {
+			var holder string
+			_ = db.QueryRowContext(ctx, "SELECT owner FROM migration_lock WHERE id = 1").Scan(&holder)
+			log.Printf("level=info msg=\"waiting for migration lock\" owner=%s holder=%s", owner, orDash(holder))
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w after %s", errMigrationLocked, migrationLockWait)
+		}
+		select {
+		case <-time.After(migrationLockPoll):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for migration lock: %w", context.Cause(ctx))
+		}
+	}
+}
+
+func migrationChecksum(m migration) string {
+	sum := sha256.Sum256([]byte(m.sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyMigrations brings db up to date with ms and returns the number of
+// migrations it applied. Re-running it is a no-op. Drift is checked for every
+// applied migration before anything new runs. The whole run holds the
+// migration lock, so an instance that waited for it finds the work done.
+func applyMigrations(ctx context.Context, db *sql.DB, ms []migration) (int, error) {
+	release, err := acquireMigrationLock(ctx, db, migrationLockOwner)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		checksum   TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return 0, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, checksum FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("read schema_migrations: %w", err)
+	}
+	recorded := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var sum string
+		if err := rows.Scan(&version, &sum); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("read schema_migrations: %w", err)
+		}
+		recorded[version] = sum
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("read schema_migrations: %w", err)
+	}
+
+	for _, m := range ms {
+		if sum, ok := recorded[m.version]; ok && sum != migrationChecksum(m) {
+			return 0, fmt.Errorf("%w: migration %d (%s) changed since it was applied: checksum %s, recorded %s",
+				errMigrationDrift, m.version, m.name, migrationChecksum(m)[:12], sum[:min(12, len(sum))])
+		}
+	}
+
+	applied := 0
+	for _, m := range ms {
+		if _, ok := recorded[m.version]; ok {
+			continue
+		}
+		if err := retryBusy(ctx, "migrate", func() error { return applyMigration(ctx, db, m) }); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("level=info msg=\"applied migration\" version=%d name=%s", m.version, m.name)
+		applied++
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, checksum, applied_at) VALUES (?, ?, ?)",
+		m.version, migrationChecksum(m), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return tx.Commit()
+}
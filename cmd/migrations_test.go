@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentMigratorsApplyOnce(t *testing.T) {
+	captureLogs(t)
+	s := newTestServer(t)
+	ms := append(append([]migration(nil), migrations...), migration{version: 100, name: "concurrent_test", sql: "CREATE TABLE concurrent_test (id INTEGER)"})
+
+	var wg sync.WaitGroup
+	applied := make([]int, 2)
+	errs := make([]error, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied[i], errs[i] = applyMigrations(t.Context(), s.db, ms)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("runner %d: %v", i, err)
+		}
+	}
+	if applied[0]+applied[1] != 1 {
+		t.Errorf("runners applied %v migrations, want exactly one between them", applied)
+	}
+}
+
+func TestMigrationLockWaitStopsOnCancel(t *testing.T) {
+	captureLogs(t)
+	s := newTestServer(t)
+	release, err := acquireMigrationLock(t.Context(), s.db, "other-host:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 150*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = acquireMigrationLock(ctx, s.db, "this-host:2")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context's deadline", err)
+	}
+	if waited := time.Since(start); waited > migrationLockWait/2 {
+		t.Errorf("waited %s after cancellation", waited)
+	}
+}
+
+func TestStaleMigrationLockIsTakenOver(t *testing.T) {
+	captureLogs(t)
+	s := newTestServer(t)
+	if _, err := s.db.Exec("INSERT INTO migration_lock (id, owner, acquired_at) VALUES (1, 'crashed:1', ?)",
+		time.Now().UTC().Add(-2*migrationLockStale).Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireMigrationLock(t.Context(), s.db, "this-host:2")
+	if err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	release()
+}
+
+func TestApplyMigrationsStopsOnCancel(t *testing.T) {
+	captureLogs(t)
+	s := newTestServer(t)
+	ms := append(append([]migration(nil), migrations...), migration{version: 100, name: "cancel_test", sql: "CREATE TABLE cancel_test (id INTEGER)"})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := applyMigrations(ctx, s.db, ms); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = 100").Scan(&n); err != nil || n != 0 {
+		t.Errorf("migration 100 applied after cancellation: n=%d err=%v", n, err)
+	}
+}
+
+func TestMigrationsApplyOnceAndDetectDrift(t *testing.T) {
+	captureLogs(t)
+	db, err := openDB(memoryDSN("migrations-" + t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, err := applyMigrations(t.Context(), db, migrations)
+	if err != nil || n != len(migrations) {
+		t.Fatalf("clean apply: %d applied, err %v; want %d", n, err, len(migrations))
+	}
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('a', 'a@example.com')"); err != nil {
+		t.Fatalf("schema not in place: %v", err)
+	}
+	if n, err := applyMigrations(t.Context(), db, migrations); err != nil || n != 0 {
+		t.Fatalf("re-apply: %d applied, err %v; want a no-op", n, err)
+	}
+
+	edited := append([]migration(nil), migrations...)
+	edited[0].sql += " -- edited"
+	if _, err := applyMigrations(t.Context(), db, edited); !errors.Is(err, errMigrationDrift) {
+		t.Fatalf("edited migration: err = %v, want errMigrationDrift", err)
+	}
+}
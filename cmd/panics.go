@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// recoverMiddleware turns a panic in the handler goroutine into a 500 so one
+// bad request doesn't take down the connection.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				log.Printf("level=error msg=\"recovered handler panic\" path=%s panic=%v", r.URL.Path, v)
+				respondError(w, r, http.StatusInternalServerError, "handler_panic",
+					"handler panic recovered by middleware", fmt.Errorf("panic: %v", v), debug.Stack())
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goroutineSampleRate is the fraction of requests goroutineWatch samples.
+var goroutineSampleRate = 0.1
+
+// goroutineWatch samples runtime.NumGoroutine before and after a fraction of
+// requests and warns when the handler left goroutines behind, making leaks
+// from routes that spawn them visible. Concurrent requests can skew a single
+// sample, so treat the warning as a hint rather than proof.
+func goroutineWatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if goroutineSampleRate <= 0 || rand.Float64() >= goroutineSampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		before := runtime.NumGoroutine()
+		next.ServeHTTP(w, r)
+		after := runtime.NumGoroutine()
+		stats.goroutineSamples.Add(1)
+		if after > before {
+			stats.goroutineGrowth.Add(1)
+			log.Printf("level=warn msg=\"goroutine count grew\" path=%s before=%d after=%d delta=%d", r.URL.Path, before, after, after-before)
+		}
+	})
+}
+
+// safeGo runs fn in a new goroutine, recovering and logging any panic. The
+// returned channel yields the recovered value (nil if fn returned normally)
+// and is then closed.
+func safeGo(name string, fn func()) <-chan any {
+	done := make(chan any, 1)
+	go func() {
+		defer close(done)
+		defer func() {
+			v := recover()
+			if v != nil {
+				log.Printf("level=error msg=\"recovered goroutine panic\" goroutine=%s panic=%v", name, v)
+			}
+			done <- v
+		}()
+		fn()
+	}()
+	return done
+}
+
+// panicSyncHandler contrasts how failures travel across goroutine patterns:
+//
+//   - mode=recovered panics in the handler goroutine, caught by recoverMiddleware (500)
+//   - mode=goroutine panics in a child goroutine, caught by safeGo (200)
+//   - mode=errgroup returns an error from one errgroup child, canceling its sibling (200)
+func panicSyncHandler(w http.ResponseWriter, r *http.Request) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "recovered":
+		panic("intentional panic in handler goroutine for demo purposes")
+
+	case "goroutine":
+		v := <-safeGo("panic-sync", func() {
+			panic("intentional panic in child goroutine for demo purposes")
+		})
+		respondJSON(w, r, http.StatusOK, map[string]any{
+			"mode":      mode,
+			"outcome":   "child goroutine panicked and safeGo recovered it; the handler kept running",
+			"recovered": v,
+		})
+
+	case "errgroup":
+		g, ctx := errgroup.WithContext(r.Context())
+		siblingCanceled := false
+		g.Go(func() error {
+			time.Sleep(50 * time.Millisecond)
+			return errors.New("intentional worker failure")
+		})
+		g.Go(func() error {
+			select {
+			case <-ctx.Done():
+				siblingCanceled = errors.Is(ctx.Err(), context.Canceled)
+				return nil
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		})
+		err := g.Wait()
+		respondJSON(w, r, http.StatusOK, map[string]any{
+			"mode":             mode,
+			"outcome":          "one child returned an error, which canceled the group's context for its sibling",
+			"error":            err.Error(),
+			"sibling_canceled": siblingCanceled,
+		})
+
+	default:
+		respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "mode must be one of recovered, goroutine, errgroup"})
+	}
+}
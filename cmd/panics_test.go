@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPanicSyncModes(t *testing.T) {
+	logs := captureLogs(t)
+	h := newHandler(newTestServer(t))
+	for _, tc := range []struct {
+		mode   string
+		status int
+		body   string
+		logMsg string
+	}{
+		{"recovered", http.StatusInternalServerError, `"code":"handler_panic"`, `msg="recovered handler panic"`},
+		{"goroutine", http.StatusOK, `"recovered":"intentional panic in child goroutine`, `msg="recovered goroutine panic" goroutine=panic-sync`},
+		{"errgroup", http.StatusOK, `"sibling_canceled":true`, ""},
+		{"bogus", http.StatusBadRequest, "mode must be one of", ""},
+	} {
+		rec := serve(h, "GET", "/panic-sync?mode="+tc.mode, nil)
+		if rec.Code != tc.status || !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("mode=%s: got %d %s, want %d containing %s", tc.mode, rec.Code, rec.Body, tc.status, tc.body)
+		}
+		if tc.logMsg != "" && !strings.Contains(logs.String(), tc.logMsg) {
+			t.Errorf("mode=%s: log lacks %s:\n%s", tc.mode, tc.logMsg, logs)
+		}
+	}
+}
+
+func TestGoroutineWatchFeedsTheGauge(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &goroutineSampleRate, 1)
+	was := panicMode.Load()
+	panicMode.Store(false) // a real /panic would take the test binary down
+	t.Cleanup(func() { panicMode.Store(was) })
+	h := newHandler(newTestServer(t))
+
+	samples := stats.goroutineSamples.Load()
+	serve(h, "GET", "/panic", nil)
+	if stats.goroutineSamples.Load() != samples+1 {
+		t.Fatal("/panic was not sampled")
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	growth := stats.goroutineGrowth.Load()
+	leaky := goroutineWatch(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		go func() { <-release }()
+	}))
+	serve(leaky, "GET", "/leaky", nil)
+	if stats.goroutineGrowth.Load() != growth+1 {
+		t.Error("a leaked goroutine was not counted")
+	}
+	if !strings.Contains(logs.String(), `msg="goroutine count grew" path=/leaky`) {
+		t.Errorf("growth not logged:\n%s", logs)
+	}
+	metrics := serve(h, "GET", "/metrics", nil).Body.String()
+	for _, want := range []string{"\ngo_goroutines ", "\ndemo_goroutine_growth_total "} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("/metrics lacks %q", strings.TrimSpace(want))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// secretFlags hold credentials; printConfig redacts them unless asked not to.
+var secretFlags = map[string]bool{"admin-token": true}
+
+// printConfigSkip are flags that select an action rather than configure
+// the server, so reproducing a config must not repeat them.
+var printConfigSkip = map[string]bool{
+	"print-config":         true,
+	"print-config-secrets": true,
+	"self-test":            true,
+}
+
+// configFlags returns every flag's effective value as name/value pairs in
+// flag order, one pair per -response-headers entry. Secret values are shown
+// as [REDACTED] unless withSecrets is set.
+func configFlags(withSecrets bool) [][2]string {
+	var kv [][2]string
+	flag.VisitAll(func(f *flag.Flag) {
+		if printConfigSkip[f.Name] {
+			return
+		}
+		if f.Name == "response-headers" {
+			// A repeatable flag: its Value doesn't remember what was passed.
+			for _, name := range slices.Sorted(maps.Keys(responseHeaders)) {
+				for _, v := range responseHeaders[name] {
+					kv = append(kv, [2]string{f.Name, name + ": " + v})
+				}
+			}
+			return
+		}
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" && !withSecrets {
+			v = "[REDACTED]"
+		}
+		kv = append(kv, [2]string{f.Name, v})
+	})
+	return kv
+}
+
+// printConfig writes the configuration to w as one command line that,
+// passed back to the binary, reproduces it.
+func printConfig(w io.Writer, withSecrets bool) {
+	var args []string
+	for _, f := range configFlags(withSecrets) {
+		args = append(args, "-"+f[0]+"="+shellQuote(f[1]))
+	}
+	fmt.Fprintln(w, strings.Join(args, " \\\n  "))
+}
+
+// logConfig logs the configuration as a single key=value line, secrets
+// redacted. Flag names become keys with dashes turned into underscores.
+func logConfig(trigger string) {
+	var b strings.Builder
+	for _, f := range configFlags(false) {
+		fmt.Fprintf(&b, " %s=%s", strings.ReplaceAll(f[0], "-", "_"), logValue(f[1]))
+	}
+	log.Printf("level=info msg=\"config dump\" trigger=%s%s", trigger, b.String())
+}
+
+// shellQuote returns s unchanged if a POSIX shell would read it literally,
+// and single-quoted otherwise.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:,=+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runMain runs main with args in a child copy of the test binary and returns
+// its stdout. Flags are registered in main, so this is the only way to see
+// the real flag set.
+func runMain(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestRunMainChild$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "DEMO_RUN_MAIN=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("main %v: %v", args, err)
+	}
+	return string(out)
+}
+
+func TestRunMainChild(t *testing.T) {
+	if os.Getenv("DEMO_RUN_MAIN") != "1" {
+		t.Skip("only runs as runMain's child")
+	}
+	os.Args = append([]string{os.Args[0]}, flag.Args()...)
+	main()
+	os.Exit(0)
+}
+
+// configArgs splits printConfig output back into arguments, undoing
+// shellQuote and dropping the test binary's own -test.* flags.
+func configArgs(out string) []string {
+	var args []string
+	for arg := range strings.SplitSeq(strings.TrimSpace(out), " \\\n  ") {
+		if strings.HasPrefix(arg, "-test.") {
+			continue
+		}
+		name, value, _ := strings.Cut(arg, "=")
+		if strings.HasPrefix(value, "'") {
+			value = strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'"), `'\''`, "'")
+		}
+		args = append(args, name+"="+value)
+	}
+	return args
+}
+
+func TestPrintConfigRoundTrips(t *testing.T) {
+	first := configArgs(runMain(t, "-print-config", "-rate=2.5", "-request-timeout=750ms",
+		"-cors-origins=https://a.example,https://b.example", "-response-headers=X-Team: it's us",
+		"-response-headers=X-Env: demo", "-admin-token=hunter2", "-log-route"))
+	for _, want := range []string{"-rate=2.5", "-request-timeout=750ms", "-cors-origins=https://a.example,https://b.example",
+		"-response-headers=X-Env: demo", "-response-headers=X-Team: it's us", "-admin-token=[REDACTED]", "-log-route=true"} {
+		if !strings.Contains("\n"+strings.Join(first, "\n")+"\n", "\n"+want+"\n") {
+			t.Errorf("printed config lacks %s:\n%s", want, strings.Join(first, "\n"))
+		}
+	}
+
+	second := configArgs(runMain(t, append([]string{"-print-config"}, first...)...))
+	if strings.Join(second, "\n") != strings.Join(first, "\n") {
+		t.Errorf("config changed on replay:\nfirst:\n%s\nsecond:\n%s", strings.Join(first, "\n"), strings.Join(second, "\n"))
+	}
+
+	withSecrets := runMain(t, "-print-config", "-print-config-secrets", "-admin-token=hunter2")
+	if !strings.Contains(withSecrets, "-admin-token=hunter2") || strings.Contains(withSecrets, "print-config") {
+		t.Errorf("-print-config-secrets output:\n%s", withSecrets)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Values accepted by -env.
+const (
+	envDev  = "dev"
+	envProd = "prod"
+)
+
+// appEnv selects how much an error response reveals. In prod, the default,
+// problems carry only a status text, a stable code and the request ID to
+// quote to support; dev, which must be asked for, adds the underlying error
+// and, for panics, the stack.
+var appEnv = envProd
+
+// respondError writes a server-side failure as JSON. msg describes the
+// failure, code is a short machine-readable name for it, and err and stack
+// are the details revealed only in dev; either may be nil.
+func respondError(w http.ResponseWriter, r *http.Request, status int, code, msg string, err error, stack []byte) {
+	payload := map[string]any{"code": code}
+	if id := w.Header().Get("X-Request-ID"); id != "" {
+		payload["request_id"] = id
+	}
+	if appEnv != envDev {
+		payload["error"] = strings.ToLower(http.StatusText(status))
+		respondJSON(w, r, status, payload)
+		return
+	}
+	payload["error"] = msg
+	if err != nil {
+		payload["detail"] = err.Error()
+	}
+	if stack != nil {
+		payload["stack"] = strings.Split(strings.TrimSpace(string(stack)), "\n")
+	}
+	respondJSON(w, r, status, payload)
+}
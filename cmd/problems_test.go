@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestErrorsHideDetailByDefault(t *testing.T) {
+	captureLogs(t)
+	if appEnv != envProd {
+		t.Fatalf("default env = %q, want %q", appEnv, envProd)
+	}
+	rec := serve(newHandler(newTestServer(t)), "GET", "/migrate", nil, "X-Request-ID", "prod-1")
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	want := map[string]any{"error": "internal server error", "code": "migration_failed", "request_id": "prod-1"}
+	if rec.Code != http.StatusInternalServerError || len(body) != len(want) {
+		t.Fatalf("got %d %v, want 500 %v", rec.Code, body, want)
+	}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("%s = %v, want %v", k, body[k], v)
+		}
+	}
+}
+
+func TestDevErrorsCarryDetail(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &appEnv, envDev)
+	rec := serve(newHandler(newTestServer(t)), "GET", "/migrate", nil)
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	if body["error"] != "migration failed" || body["detail"] == nil {
+		t.Errorf("dev body = %v, want the message and the SQL error", body)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Shape of the /race-demo workload: raceWorkers goroutines each bump every
+// key in raceKeys raceIterations times.
+const (
+	raceWorkers    = 8
+	raceIterations = 10000
+)
+
+var raceKeys = []string{"a", "b", "c", "d"}
+
+// raceDemoHandler counts into a shared map from several goroutines.
+//
+// With ?safe=true (the default) every update holds a mutex, so the total is
+// always exact. With ?safe=false the goroutines increment the map's values
+// with no synchronisation at all: a data race that `go run -race` reports and
+// that usually loses updates. It is for demonstration only. The unsafe mode
+// only ever reads the map itself and races on the counters it points to,
+// because racing writes to the map would make the runtime abort the whole
+// process with "concurrent map writes", which no recover can catch.
+func raceDemoHandler(w http.ResponseWriter, r *http.Request) {
+	safe := true
+	if v := r.URL.Query().Get("safe"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			respondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "safe must be a boolean"})
+			return
+		}
+		safe = b
+	}
+
+	var counted int
+	if safe {
+		counted = countSafely()
+	} else {
+		counted = countRacily()
+	}
+	expected := raceWorkers * raceIterations * len(raceKeys)
+	addLogField(r.Context(), "lost_updates", expected-counted)
+	if counted != expected {
+		log.Printf("level=warn msg=\"race demo lost updates\" expected=%d counted=%d lost=%d", expected, counted, expected-counted)
+	}
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"safe":         safe,
+		"expected":     expected,
+		"counted":      counted,
+		"lost_updates": expected - counted,
+	})
+}
+
+// countSafely serialises every increment behind a mutex.
+func countSafely() int {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	runRaceWorkers(func(key string) {
+		mu.Lock()
+		counts[key]++
+		mu.Unlock()
+	})
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// countRacily increments shared counters with no synchronisation. This is
+// the bug being demonstrated; don't copy it.
+func countRacily() int {
+	counts := make(map[string]*int, len(raceKeys))
+	for _, k := range raceKeys {
+		counts[k] = new(int)
+	}
+	runRaceWorkers(func(key string) {
+		*counts[key]++
+	})
+	total := 0
+	for _, n := range counts {
+		total += *n
+	}
+	return total
+}
+
+func runRaceWorkers(inc func(key string)) {
+	var wg sync.WaitGroup
+	for range raceWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range raceIterations {
+				for _, k := range raceKeys {
+					inc(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
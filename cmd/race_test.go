@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Run with -race: the safe mode must come back exact and clean. The unsafe
+// mode is left out on purpose, since the detector rightly fails it.
+func TestRaceDemoSafeModeIsExact(t *testing.T) {
+	captureLogs(t)
+	rec := serve(newHandler(newTestServer(t)), "GET", "/race-demo?safe=true", nil)
+	var body struct {
+		Safe     bool `json:"safe"`
+		Expected int  `json:"expected"`
+		Counted  int  `json:"counted"`
+		Lost     int  `json:"lost_updates"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if !body.Safe || body.Lost != 0 || body.Counted != body.Expected || body.Expected != raceWorkers*raceIterations*len(raceKeys) {
+		t.Errorf("safe mode = %+v, want every update counted", body)
+	}
+}
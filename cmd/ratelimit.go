@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	globalRate  float64
+	globalBurst = 10
+	ipRate      float64
+	ipBurst     = 5
+	// rateLimitExempt are probe and scrape paths that only an explicit
+	// -route-rate entry limits: throttling them under load would get a
+	// healthy instance restarted or blind its monitoring.
+	rateLimitExempt = []string{"/livez", "/readyz", "/health", "/metrics"}
+)
+
+// An IP's bucket is dropped after ipLimiterIdle without requests; the sweep
+// runs every ipLimiterSweep.
+const (
+	ipLimiterIdle  = 3 * time.Minute
+	ipLimiterSweep = time.Minute
+)
+
+// routeLimiter throttles requests with one token bucket per configured path
+// and a shared global bucket for everything else. Both maps are built at
+// startup and never modified, and rate.Limiter is safe for concurrent use.
+type routeLimiter struct {
+	global *rate.Limiter // nil when global limiting is off
+	routes map[string]*rate.Limiter
+	perIP  *ipLimiter // nil when per-client limiting is off
+}
+
+// ipLimiter gives each client IP its own token bucket. Unlike routeLimiter's
+// maps, clients changes on the request path and in the eviction sweep, so
+// every access holds mu. The bucket itself is used outside the lock: a
+// rate.Limiter is safe for concurrent use, and one evicted mid-request just
+// means that client starts over with a full bucket.
+type ipLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*ipClient
+}
+
+type ipClient struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiter(rps float64, burst int) *ipLimiter {
+	return &ipLimiter{limit: rate.Limit(rps), burst: burst, clients: make(map[string]*ipClient)}
+}
+
+// allow takes a token from ip's bucket, creating it on first sight.
+func (l *ipLimiter) allow(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &ipClient{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	lim := c.lim
+	l.mu.Unlock()
+	return lim.AllowN(now, 1)
+}
+
+// evict drops buckets idle since before cutoff and returns how many it dropped.
+func (l *ipLimiter) evict(cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for ip, c := range l.clients {
+		if c.lastSeen.Before(cutoff) {
+			delete(l.clients, ip)
+			n++
+		}
+	}
+	return n
+}
+
+// evictLoop sweeps idle buckets until ctx is cancelled, so the map doesn't
+// grow with every client ever seen.
+func (l *ipLimiter) evictLoop(ctx context.Context) {
+	t := time.NewTicker(ipLimiterSweep)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if n := l.evict(time.Now().Add(-ipLimiterIdle)); n > 0 {
+				log.Printf("level=debug msg=\"evicted idle rate limit buckets\" evicted=%d", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newRouteLimiter parses a spec like "/migrate:1:1,/slow:5:10" (path:rps:burst)
+// into per-route limits layered over the global rps/burst. A global rps of 0
+// leaves unlisted routes unlimited.
+func newRouteLimiter(spec string, rps float64, burst int) (*routeLimiter, error) {
+	l := &routeLimiter{routes: make(map[string]*rate.Limiter)}
+	if rps > 0 {
+		l.global = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+	for _, entry := range splitList(spec) {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid route rate %q: want /path:rps:burst", entry)
+		}
+		routeRPS, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || routeRPS <= 0 {
+			return nil, fmt.Errorf("invalid rps in %q: want a positive number", entry)
+		}
+		routeBurst, err := strconv.Atoi(parts[2])
+		if err != nil || routeBurst < 1 {
+			return nil, fmt.Errorf("invalid burst in %q: want a positive integer", entry)
+		}
+		l.routes[parts[0]] = rate.NewLimiter(rate.Limit(routeRPS), routeBurst)
+	}
+	return l, nil
+}
+
+// limiterFor returns the bucket governing path, or nil if it is unlimited.
+func (l *routeLimiter) limiterFor(path string) *rate.Limiter {
+	if lim, ok := l.routes[path]; ok {
+		return lim
+	}
+	if slices.Contains(rateLimitExempt, path) {
+		return nil
+	}
+	return l.global
+}
+
+// middleware answers 429 once the request's route or client bucket is empty.
+func (l *routeLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		limited := ""
+		if lim := l.limiterFor(r.URL.Path); lim != nil && !lim.Allow() {
+			limited = "route"
+		} else if l.perIP != nil && !slices.Contains(rateLimitExempt, r.URL.Path) && !l.perIP.allow(ip) {
+			limited = "client"
+		}
+		if limited != "" {
+			log.Printf("level=warn msg=\"rate limited\" path=%s client_ip=%s scope=%s", r.URL.Path, ip, limited)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
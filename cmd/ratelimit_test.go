@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func limitedHandler(t *testing.T, spec string, rps float64, burst int) http.Handler {
+	t.Helper()
+	s := newTestServer(t)
+	l, err := newRouteLimiter(spec, rps, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.limiter = l
+	return newHandler(s)
+}
+
+func statuses(h http.Handler, method, target string, n int) []int {
+	var got []int
+	for range n {
+		got = append(got, serve(h, method, target, nil).Code)
+	}
+	return got
+}
+
+func TestRouteRateIsStricterThanGlobal(t *testing.T) {
+	captureLogs(t)
+	h := limitedHandler(t, "/migrate:1:1", 100, 100)
+	if got := statuses(h, "GET", "/migrate", 3); got[0] == http.StatusTooManyRequests || got[1] != http.StatusTooManyRequests || got[2] != http.StatusTooManyRequests {
+		t.Errorf("/migrate statuses = %v, want one pass then 429s", got)
+	}
+	for i, code := range statuses(h, "GET", "/", 5) {
+		if code != http.StatusOK {
+			t.Errorf("/ request %d: status %d, want 200 under the global limit", i, code)
+		}
+	}
+}
+
+func TestProbesAreExemptFromGlobalLimit(t *testing.T) {
+	logs := captureLogs(t)
+	h := limitedHandler(t, "", 1, 1)
+	for _, path := range rateLimitExempt {
+		for i, code := range statuses(h, "GET", path, 3) {
+			if code == http.StatusTooManyRequests {
+				t.Errorf("%s request %d was rate limited", path, i)
+			}
+		}
+	}
+	if got := statuses(h, "GET", "/", 2); got[1] != http.StatusTooManyRequests {
+		t.Errorf("/ statuses = %v, want the second one throttled", got)
+	}
+	if line := logLine(logs.String(), `msg="rate limited"`); line == "" {
+		t.Error("no rate limited log line")
+	}
+}
+
+func TestPerIPLimitSkipsProbes(t *testing.T) {
+	captureLogs(t)
+	s := newTestServer(t)
+	l, _ := newRouteLimiter("", 0, 0)
+	l.perIP = newIPLimiter(1, 1)
+	s.limiter = l
+	h := newHandler(s)
+	if got := statuses(h, "GET", "/livez", 3); got[2] != http.StatusOK {
+		t.Errorf("/livez statuses = %v, want all 200", got)
+	}
+	if got := statuses(h, "GET", "/", 2); got[1] != http.StatusTooManyRequests {
+		t.Errorf("/ statuses = %v, want the client throttled", got)
+	}
+}
+
+// Run with -race: request-path inserts and eviction sweeps share the map.
+func TestIPLimiterUnderConcurrentLoad(t *testing.T) {
+	l := newIPLimiter(1000, 5)
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				l.evict(time.Now().Add(-time.Millisecond))
+			}
+		}
+	}()
+	var clients sync.WaitGroup
+	for g := range 32 {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for i := range 500 {
+				ip := fmt.Sprintf("10.0.%d.%d", g, i%64)
+				if i%2 == 0 {
+					ip = fmt.Sprintf("2001:db8::%x", i%128)
+				}
+				if l.allow(ip) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	wg.Wait()
+
+	if allowed.Load() == 0 {
+		t.Error("no request was allowed")
+	}
+	if n := l.evict(time.Now().Add(time.Second)); n > 64*32+128 {
+		t.Errorf("evicted %d buckets, more than the %d clients seen", n, 64*32+128)
+	}
+	if len(l.clients) != 0 {
+		t.Errorf("%d buckets left after evicting everything", len(l.clients))
+	}
+}
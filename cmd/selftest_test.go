@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestPasses(t *testing.T) {
+	logs := captureLogs(t)
+	was := panicMode.Load()
+	t.Cleanup(func() { panicMode.Store(was) })
+
+	if code := runSelfTest(); code != 0 {
+		t.Fatalf("runSelfTest() = %d, want 0:\n%s", code, logs)
+	}
+	out := logs.String()
+	if n := strings.Count(out, "result=pass"); n != len(selfTestChecks)+2 {
+		t.Errorf("%d checks passed, want %d:\n%s", n, len(selfTestChecks)+2, out)
+	}
+	if !strings.Contains(out, `msg="self-test passed"`) || strings.Contains(out, "result=fail") {
+		t.Errorf("unexpected verdict:\n%s", out)
+	}
+}
+
+func TestSelfTestFailsOnABrokenCheck(t *testing.T) {
+	logs := captureLogs(t)
+	was := panicMode.Load()
+	t.Cleanup(func() { panicMode.Store(was) })
+	setForTest(t, &selfTestChecks, append(selfTestChecks[:len(selfTestChecks):len(selfTestChecks)],
+		selfTestCheck{"GET", "/", http.StatusTeapot, ""}))
+
+	if code := runSelfTest(); code != 1 {
+		t.Fatalf("runSelfTest() = %d, want 1", code)
+	}
+	if !strings.Contains(logs.String(), `check="GET /" result=fail err=status 200, want 418`) {
+		t.Errorf("failing check not reported:\n%s", logs)
+	}
+}
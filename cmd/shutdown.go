@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var (
+	shutdownDrain   = 5 * time.Second
+	shutdownTimeout = 10 * time.Second
+	shutdownExempt  = []string{"/livez"}
+)
+
+// shutdownMiddleware answers 503 once shutdown has begun, so load balancers
+// steer traffic away during the drain window. Paths in shutdownExempt keep
+// working so liveness probes don't flap.
+func (s *server) shutdownMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.shuttingDown.Load() && !slices.Contains(shutdownExempt, r.URL.Path) {
+			s.drainRefused.Add(1)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gracefulShutdown flips the server into draining mode, waits shutdownDrain
+// for peers to notice, then stops hs, giving in-flight requests up to
+// shutdownTimeout to finish. Background workers are stopped next, before the
+// shutdown hooks release what they might still be using.
+func (s *server) gracefulShutdown(hs *http.Server) {
+	log.Printf("level=info msg=\"shutdown started\" drain=%s timeout=%s", shutdownDrain, shutdownTimeout)
+	conns := stats.connsOpened.Load()
+	s.shuttingDown.Store(true)
+	time.Sleep(shutdownDrain)
+
+	// Shutdown closes the listeners first. Connections the kernel queued but
+	// the server never accepted are reset then; they are not counted here.
+	log.Printf("level=info msg=\"closing listeners\" accepted_during_drain=%d refused_during_drain=%d in_flight=%d",
+		stats.connsOpened.Load()-conns, s.drainRefused.Load(), stats.inFlight.Load())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("level=error msg=\"shutdown incomplete\" err=%v", err)
+	}
+	s.stopWorkers(ctx)
+	s.runShutdownHooks(ctx)
+	log.Println("level=info msg=\"shutdown complete\"")
+}
+
+// minHookTimeout is the least time a shutdown hook gets, even if draining
+// requests used up the whole shutdown deadline.
+const minHookTimeout = 100 * time.Millisecond
+
+// shutdownHook releases a resource during shutdown. fn should honour ctx, but
+// hooks that don't are abandoned once their slice of the deadline runs out.
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// onShutdown registers a hook to run, in registration order, after the HTTP
+// server has stopped.
+func (s *server) onShutdown(name string, fn func(ctx context.Context) error) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name, fn})
+}
+
+// runShutdownHooks gives each hook an equal share of the time left before
+// ctx's deadline, so one stuck hook can't starve the ones after it.
+func (s *server) runShutdownHooks(ctx context.Context) {
+	s.hooksMu.Lock()
+	hooks := slices.Clone(s.hooks)
+	s.hooksMu.Unlock()
+
+	for i, h := range hooks {
+		budget := minHookTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			budget = max(time.Until(deadline)/time.Duration(len(hooks)-i), minHookTimeout)
+		}
+		hookCtx, cancel := context.WithTimeout(context.Background(), budget)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() { done <- h.fn(hookCtx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("level=error msg=\"shutdown hook failed\" hook=%s duration=%s err=%v", h.name, time.Since(start), err)
+			} else {
+				log.Printf("level=info msg=\"shutdown hook finished\" hook=%s duration=%s", h.name, time.Since(start))
+			}
+		case <-hookCtx.Done():
+			log.Printf("level=error msg=\"shutdown hook timed out\" hook=%s timeout=%s", h.name, budget)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startShutdown runs gracefulShutdown on ts in the background and waits for
+// the drain window to open. The returned channel closes when it is done.
+func startShutdown(t *testing.T, s *server, ts *httptest.Server) <-chan struct{} {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.gracefulShutdown(ts.Config)
+	}()
+	for !s.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestDrainKeepsLivenessUp(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &shutdownDrain, 200*time.Millisecond)
+	s := newTestServer(t)
+	ts := httptest.NewServer(newHandler(s))
+	defer ts.Close()
+	done := startShutdown(t, s, ts)
+
+	for path, want := range map[string]int{"/livez": http.StatusOK, "/": http.StatusServiceUnavailable} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s during drain: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s during drain = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	<-done
+	if s.drainRefused.Load() != 1 {
+		t.Errorf("drainRefused = %d, want 1", s.drainRefused.Load())
+	}
+}
+
+func TestBlockingShutdownHookIsTimedOut(t *testing.T) {
+	logs := captureLogs(t)
+	s := newServer(nil)
+	var stuckRan, afterRan atomic.Bool
+	s.onShutdown("stuck", func(context.Context) error {
+		stuckRan.Store(true)
+		select {} // ignores its context
+	})
+	s.onShutdown("after", func(context.Context) error {
+		afterRan.Store(true)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 400*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.runShutdownHooks(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hooks took %s, want the deadline to bound them", elapsed)
+	}
+	if !stuckRan.Load() || !afterRan.Load() {
+		t.Errorf("stuck ran %t, after ran %t; want both", stuckRan.Load(), afterRan.Load())
+	}
+	if !strings.Contains(logs.String(), `msg="shutdown hook timed out" hook=stuck`) ||
+		!strings.Contains(logs.String(), `msg="shutdown hook finished" hook=after`) {
+		t.Errorf("hook outcomes not logged:\n%s", logs)
+	}
+}
+
+func TestConnectionFloodDuringShutdown(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &shutdownDrain, 150*time.Millisecond)
+	setForTest(t, &shutdownTimeout, 2*time.Second)
+	s := newTestServer(t)
+	ts := httptest.NewUnstartedServer(newHandler(s))
+	ts.Config.ConnState = stats.trackConn
+	ts.Start()
+	defer ts.Close()
+	client := &http.Client{Timeout: 3 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := client.Get(ts.URL + "/slow?delay=300ms")
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := startShutdown(t, s, ts)
+
+	var drained, refused, hung atomic.Int64
+	var flood sync.WaitGroup
+	for range 20 {
+		flood.Add(1)
+		go func() {
+			defer flood.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				resp, err := client.Get(ts.URL + "/")
+				var ne net.Error
+				switch {
+				case errors.As(err, &ne) && ne.Timeout():
+					hung.Add(1)
+				case err != nil:
+					refused.Add(1) // listener closed: refused or reset
+				default:
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode == http.StatusServiceUnavailable {
+						drained.Add(1)
+					} else {
+						t.Errorf("request during shutdown = %d, want 503", resp.StatusCode)
+					}
+				}
+			}
+		}()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hung under a connection flood")
+	}
+	flood.Wait()
+
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("request in flight at shutdown = %d, want it drained with 200", code)
+	}
+	if hung.Load() != 0 || drained.Load() == 0 || refused.Load() == 0 {
+		t.Errorf("drained=%d refused=%d hung=%d, want 503s during the drain, refusals after and no hangs", drained.Load(), refused.Load(), hung.Load())
+	}
+	line := logLine(logs.String(), `msg="closing listeners"`)
+	if !strings.Contains(line, "refused_during_drain="+strconv.FormatInt(s.drainRefused.Load(), 10)+" ") || strings.Contains(line, "accepted_during_drain=0 ") {
+		t.Errorf("closing line = %q, want the drain's counts", line)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultSlowDelay is how long /slow sleeps when the client doesn't say.
+const defaultSlowDelay = 6 * time.Second
+
+var (
+	slowMaxDelay = 30 * time.Second
+
+	slowRNGMu sync.Mutex
+	slowRNG   = rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), 0))
+)
+
+// seedSlowRNG makes /slow's random delays reproducible.
+func seedSlowRNG(seed uint64) {
+	slowRNGMu.Lock()
+	defer slowRNGMu.Unlock()
+	slowRNG = rand.New(rand.NewPCG(seed, 0))
+}
+
+func slowRandFloat(exp bool) float64 {
+	slowRNGMu.Lock()
+	defer slowRNGMu.Unlock()
+	if exp {
+		return slowRNG.ExpFloat64()
+	}
+	return slowRNG.Float64()
+}
+
+// slowDelaySource reports whether the client chose /slow's delay ("client")
+// or left every delay parameter unset ("default").
+func slowDelaySource(q url.Values) string {
+	for _, k := range []string{"dist", "delay", "min", "max", "mean"} {
+		if q.Has(k) {
+			return "client"
+		}
+	}
+	return "default"
+}
+
+// slowDelay picks /slow's delay from the distribution named by ?dist=:
+//
+//   - constant (default): ?delay= (default 6s)
+//   - uniform: between ?min= (default 0) and ?max= (default 6s)
+//   - exponential: with mean ?mean= (default 1s)
+//
+// Results are clamped to [0, slowMaxDelay]. Random delays are clamped while
+// still float64, since a large ?mean= or ?max= can overflow a Duration.
+func slowDelay(q url.Values) (time.Duration, error) {
+	var d time.Duration
+	switch dist := q.Get("dist"); dist {
+	case "", "constant":
+		var err error
+		if d, err = durationParam(q, "delay", defaultSlowDelay); err != nil {
+			return 0, err
+		}
+	case "uniform":
+		lo, err := durationParam(q, "min", 0)
+		if err != nil {
+			return 0, err
+		}
+		hi, err := durationParam(q, "max", defaultSlowDelay)
+		if err != nil {
+			return 0, err
+		}
+		if hi < lo {
+			return 0, fmt.Errorf("max %s is below min %s", hi, lo)
+		}
+		d = clampDelay(float64(lo) + slowRandFloat(false)*float64(hi-lo))
+	case "exponential":
+		mean, err := durationParam(q, "mean", time.Second)
+		if err != nil {
+			return 0, err
+		}
+		d = clampDelay(slowRandFloat(true) * float64(mean))
+	default:
+		return 0, fmt.Errorf("unknown dist %q: want constant, uniform or exponential", dist)
+	}
+	return max(min(d, slowMaxDelay), 0), nil
+}
+
+// clampDelay converts a generated delay in nanoseconds to a Duration within
+// [0, slowMaxDelay].
+func clampDelay(ns float64) time.Duration {
+	return max(time.Duration(min(ns, float64(slowMaxDelay))), 0)
+}
+
+// durationParam parses a non-negative duration query parameter.
+func durationParam(q url.Values, name string, def time.Duration) (time.Duration, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: want a non-negative duration such as 500ms", name, v)
+	}
+	return d, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowDelayDistributions(t *testing.T) {
+	setForTest(t, &slowRNG, slowRNG)
+	setForTest(t, &slowMaxDelay, 30*time.Second)
+	draw := func(query string, n int) []time.Duration {
+		t.Helper()
+		q, _ := url.ParseQuery(query)
+		ds := make([]time.Duration, n)
+		for i := range ds {
+			d, err := slowDelay(q)
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			ds[i] = d
+		}
+		return ds
+	}
+
+	for _, d := range draw("delay=250ms", 5) {
+		if d != 250*time.Millisecond {
+			t.Fatalf("constant delay %s, want 250ms", d)
+		}
+	}
+	for _, d := range draw("dist=uniform&min=100ms&max=200ms", 500) {
+		if d < 100*time.Millisecond || d >= 200*time.Millisecond {
+			t.Fatalf("uniform delay %s outside [100ms, 200ms)", d)
+		}
+	}
+	var sum time.Duration
+	exp := draw("dist=exponential&mean=100ms", 2000)
+	for _, d := range exp {
+		if d < 0 {
+			t.Fatalf("negative exponential delay %s", d)
+		}
+		sum += d
+	}
+	if mean := sum / time.Duration(len(exp)); mean < 85*time.Millisecond || mean > 115*time.Millisecond {
+		t.Errorf("exponential mean %s, want about 100ms", mean)
+	}
+
+	setForTest(t, &slowMaxDelay, 50*time.Millisecond)
+	if d := draw("delay=1h", 1)[0]; d != 50*time.Millisecond {
+		t.Errorf("delay=1h gave %s, want it clamped to 50ms", d)
+	}
+
+	seedSlowRNG(42)
+	first := draw("dist=uniform&max=1s", 3)
+	seedSlowRNG(42)
+	if again := draw("dist=uniform&max=1s", 3); again[0] != first[0] || again[2] != first[2] {
+		t.Errorf("same seed drew %v then %v", first, again)
+	}
+
+	for _, bad := range []string{"dist=normal", "dist=uniform&min=2s&max=1s", "delay=-1s", "delay=soon"} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := slowDelay(q); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestHugeDelayParamsStayClamped(t *testing.T) {
+	setForTest(t, &slowRNG, slowRNG)
+	setForTest(t, &slowMaxDelay, 30*time.Second)
+	// math.MaxInt64 nanoseconds, the longest Duration there is.
+	longest := time.Duration(math.MaxInt64).String()
+	for _, query := range []string{
+		"dist=exponential&mean=2562047h",
+		"dist=exponential&mean=" + longest,
+		"dist=uniform&max=" + longest,
+		"dist=uniform&min=2562047h&max=" + longest,
+	} {
+		q, _ := url.ParseQuery(query)
+		for range 1000 {
+			d, err := slowDelay(q)
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			if d < 0 || d > slowMaxDelay {
+				t.Fatalf("%s gave %s, want 0 <= d <= %s", query, d, slowMaxDelay)
+			}
+		}
+	}
+}
+
+func TestSlowLogsTheDeliveredDelay(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &slowMaxDelay, 20*time.Millisecond)
+	h := newHandler(newTestServer(t))
+	serve(h, "GET", "/slow?delay=5ms", nil)
+	serve(h, "GET", "/slow", nil) // 6s default, clamped to slowMaxDelay
+	for _, want := range []string{
+		`level=info msg="slow response delivered" path=/slow delay=5ms source=client`,
+		`level=info msg="slow response delivered" path=/slow delay=20ms source=default`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no %q in:\n%s", want, logs)
+		}
+	}
+}
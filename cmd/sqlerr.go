@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dbReadOnly opens the DB with query_only set, rejecting every write.
+var dbReadOnly bool
+
+// readOnlyDSN returns dsn with SQLite's query_only pragma enabled. Unlike
+// mode=ro it also works for in-memory databases.
+func readOnlyDSN(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "_pragma=query_only(1)"
+}
+
+// sqliteCode returns the primary SQLite result code behind err, or 0 if err
+// didn't come from the driver.
+func sqliteCode(err error) int {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return 0
+	}
+	return se.Code() & 0xff // strip the extended-code bits
+}
+
+// isReadOnly reports whether err is SQLite refusing a write to a read-only DB.
+func isReadOnly(err error) bool {
+	return sqliteCode(err) == sqlite3.SQLITE_READONLY
+}
+
+// isBusy reports whether err is SQLite giving up on a lock another connection
+// holds: SQLITE_BUSY for file locks, SQLITE_LOCKED for shared-cache table
+// locks. Both are transient, unlike genuine SQL errors.
+func isBusy(err error) bool {
+	code := sqliteCode(err)
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// Retry schedule for busy errors: busyRetries attempts after the first,
+// starting at busyBackoff and doubling.
+const (
+	busyRetries = 5
+	busyBackoff = 10 * time.Millisecond
+)
+
+// retryBusy runs fn, retrying with backoff while it fails with a busy error.
+// Any other error, or ctx ending, returns immediately. op names the work in
+// the retry log lines.
+func retryBusy(ctx context.Context, op string, fn func() error) error {
+	delay := busyBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isBusy(err) || attempt > busyRetries {
+			return err
+		}
+		log.Printf("level=warn msg=\"database busy, retrying\" op=%s attempt=%d retry_in=%s err=%v", op, attempt, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// requireWritable rejects write routes up front when the DB is read-only,
+// rather than letting them fail on whatever the first statement trips over.
+func requireWritable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbReadOnly {
+			respondReadOnly(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func respondReadOnly(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, r, http.StatusForbidden, map[string]string{
+		"error":  "database is read-only",
+		"detail": "this instance was started with -db-readonly; write operations are disabled",
+	})
+}
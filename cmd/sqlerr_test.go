@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockedFileDB returns a handle on a file-backed DB whose only table is
+// write-locked by a transaction on a second handle, so writes through the
+// first fail with SQLITE_BUSY. The shared-cache memory DBs the server uses
+// wait for locks instead of reporting them. The returned func ends the
+// transaction.
+func lockedFileDB(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "busy.db")
+	var dbs [2]*sql.DB
+	for i := range dbs {
+		db, err := openDB("file:" + path)
+		if err != nil {
+			t.Fatalf("openDB: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		dbs[i] = db
+	}
+	if _, err := dbs[0].Exec("CREATE TABLE items (name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := dbs[1].Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO items VALUES ('holder')"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	return dbs[0], func() { tx.Commit() }
+}
+
+func TestRetryBusySucceedsOnceTheLockIsReleased(t *testing.T) {
+	logs := captureLogs(t)
+	db, release := lockedFileDB(t)
+	time.AfterFunc(30*time.Millisecond, release)
+
+	err := retryBusy(t.Context(), "test_insert", func() error {
+		_, err := db.Exec("INSERT INTO items VALUES ('writer')")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("retryBusy: %v", err)
+	}
+	if !strings.Contains(logs.String(), `msg="database busy, retrying" op=test_insert`) {
+		t.Errorf("no busy retry was logged:\n%s", logs)
+	}
+}
+
+func TestRetryBusyStopsWhenContextEnds(t *testing.T) {
+	captureLogs(t)
+	db, _ := lockedFileDB(t)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 15*time.Millisecond)
+	defer cancel()
+	attempts := 0
+	err := retryBusy(ctx, "test_insert", func() error {
+		attempts++
+		_, err := db.Exec("INSERT INTO items VALUES ('writer')")
+		return err
+	})
+	if !isBusy(err) {
+		t.Fatalf("err = %v, want the busy error", err)
+	}
+	if attempts > 2 {
+		t.Errorf("%d attempts after the context ended, want retries to stop", attempts)
+	}
+}
+
+func TestRetryBusyReturnsSQLErrorsAtOnce(t *testing.T) {
+	s := newTestServer(t)
+	attempts := 0
+	err := retryBusy(t.Context(), "bad_sql", func() error {
+		attempts++
+		_, err := s.db.Exec("INSERT INTO imaginary VALUES (1)")
+		return err
+	})
+	if err == nil || isBusy(err) || attempts != 1 {
+		t.Errorf("err = %v after %d attempts, want one non-busy failure", err, attempts)
+	}
+}
+
+func TestReadOnlyDBRejectsMigrations(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &dbReadOnly, true)
+	db, err := openDB(readOnlyDSN(memoryDSN("readonly-" + t.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newServer(db)
+	if err := s.warmUp(t.Context()); err != nil {
+		t.Fatalf("warm-up on a read-only DB: %v", err)
+	}
+	s.ready.Store(true)
+
+	rec := serve(newHandler(s), "POST", "/migrate", nil)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "database is read-only") {
+		t.Errorf("/migrate = %d %s, want 403 database is read-only", rec.Code, rec.Body)
+	}
+	// Writes that get past the route guard fail as read-only, not as SQL errors.
+	if _, err := db.Exec("CREATE TABLE t (id INTEGER)"); !isReadOnly(err) {
+		t.Errorf("write on a read-only DB: err = %v, want SQLITE_READONLY", err)
+	}
+}
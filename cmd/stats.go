@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// requestStats counts how logged requests ended. It backs both /stats and
+// /metrics.
+type requestStats struct {
+	completed      atomic.Int64
+	clientCanceled atomic.Int64
+	serverTimeout  atomic.Int64
+
+	connsOpened atomic.Int64 // TCP connections accepted
+	requests    atomic.Int64 // requests received on any connection
+	inFlight    atomic.Int64 // requests currently being handled
+
+	goroutineSamples atomic.Int64 // requests goroutineWatch sampled
+	goroutineGrowth  atomic.Int64 // sampled requests that left goroutines behind
+
+	stmtHits   atomic.Int64 // prepared statement cache hits
+	stmtMisses atomic.Int64 // statements prepared on a cache miss
+}
+
+var stats requestStats
+
+// recordOutcome classifies a finished request by its context's cancelCause.
+// Deadlines other than timeoutMiddleware's also count as server timeouts.
+func (st *requestStats) recordOutcome(ctx context.Context) {
+	switch cancelCause(ctx) {
+	case "":
+		st.completed.Add(1)
+	case "client_cancel":
+		st.clientCanceled.Add(1)
+	default:
+		st.serverTimeout.Add(1)
+	}
+}
+
+// trackConn is an http.Server ConnState hook counting new connections.
+func (st *requestStats) trackConn(_ net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		st.connsOpened.Add(1)
+	}
+}
+
+type requestStartKey struct{}
+
+// countRequests counts every request reaching the server, logged or not,
+// and tracks how many are in flight. Only uriLimitMiddleware runs ahead of
+// it, so it also records when the request arrived for requestStart.
+func (st *requestStats) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st.requests.Add(1)
+		st.inFlight.Add(1)
+		defer st.inFlight.Add(-1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestStartKey{}, time.Now())))
+	})
+}
+
+// requestStart returns when countRequests first saw the request ctx belongs
+// to, or now if it never did.
+func requestStart(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(requestStartKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// reuseRatio is the fraction of requests served on an already-open
+// connection: 0 when every request dials fresh, approaching 1 with keep-alive.
+func (st *requestStats) reuseRatio() float64 {
+	reqs := st.requests.Load()
+	if reqs == 0 {
+		return 0
+	}
+	return max(float64(reqs-st.connsOpened.Load())/float64(reqs), 0)
+}
+
+// statsHandler reports request counters as JSON.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, r, http.StatusOK, map[string]any{
+		"requests": map[string]any{
+			"completed": stats.completed.Load(),
+			"canceled": map[string]int64{
+				"client_cancel":  stats.clientCanceled.Load(),
+				"server_timeout": stats.serverTimeout.Load(),
+			},
+		},
+		"connections": map[string]any{
+			"opened":      stats.connsOpened.Load(),
+			"requests":    stats.requests.Load(),
+			"reuse_ratio": stats.reuseRatio(),
+			"in_flight":   stats.inFlight.Load(),
+		},
+		"goroutines": map[string]any{
+			"current":        runtime.NumGoroutine(),
+			"samples":        stats.goroutineSamples.Load(),
+			"growth_samples": stats.goroutineGrowth.Load(),
+		},
+		"statement_cache": map[string]any{
+			"hits":   stats.stmtHits.Load(),
+			"misses": stats.stmtMisses.Load(),
+		},
+	})
+}
+
+// Content types for the two /metrics exposition formats.
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// metricsHandler exposes the same counters in the Prometheus text format, or
+// in OpenMetrics when the Accept header asks for application/openmetrics-text.
+// The samples are identical; OpenMetrics names counter families without the
+// _total suffix and ends the exposition with "# EOF".
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	w.Header().Add("Vary", "Accept")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+	family := func(name, typ, help string) {
+		if openMetrics && typ == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	family("http_requests_completed_total", "counter", "Requests that finished without their context being canceled.")
+	fmt.Fprintf(w, "http_requests_completed_total %d\n", stats.completed.Load())
+	family("http_requests_canceled_total", "counter", "Requests whose context was canceled before the handler returned.")
+	fmt.Fprintf(w, "http_requests_canceled_total{reason=\"client_cancel\"} %d\n", stats.clientCanceled.Load())
+	fmt.Fprintf(w, "http_requests_canceled_total{reason=\"server_timeout\"} %d\n", stats.serverTimeout.Load())
+	family("http_connections_opened_total", "counter", "TCP connections accepted.")
+	fmt.Fprintf(w, "http_connections_opened_total %d\n", stats.connsOpened.Load())
+	family("http_requests_received_total", "counter", "Requests received on any connection.")
+	fmt.Fprintf(w, "http_requests_received_total %d\n", stats.requests.Load())
+	family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	family("demo_goroutine_growth_total", "counter", "Sampled requests after which the goroutine count had grown.")
+	fmt.Fprintf(w, "demo_goroutine_growth_total %d\n", stats.goroutineGrowth.Load())
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveCanceled sends target through h with a context the client abandons
+// after wait.
+func serveCanceled(h http.Handler, target string, wait time.Duration) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(wait, cancel)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, "GET", target, nil))
+	return rec
+}
+
+func TestCanceledSlowRequestIsCounted(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+	canceled, completed := stats.clientCanceled.Load(), stats.completed.Load()
+
+	start := time.Now()
+	serveCanceled(h, "/slow?delay=2s", 20*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("/slow kept going %s after the client left", elapsed)
+	}
+	if got := stats.clientCanceled.Load() - canceled; got != 1 {
+		t.Errorf("client cancellations rose by %d, want 1", got)
+	}
+	if stats.completed.Load() != completed {
+		t.Error("the canceled request was counted as completed")
+	}
+}
+
+// zeroForTest zeroes the counters for the rest of the test, since they are
+// process-wide and other tests move them too.
+func zeroForTest(t *testing.T, counters ...*atomic.Int64) {
+	t.Helper()
+	for _, c := range counters {
+		old := c.Swap(0)
+		t.Cleanup(func() { c.Store(old) })
+	}
+}
+
+func TestReuseRatioCountsKeepAliveRequests(t *testing.T) {
+	captureLogs(t)
+	zeroForTest(t, &stats.requests, &stats.connsOpened)
+	ts := httptest.NewUnstartedServer(newHandler(newTestServer(t)))
+	ts.Config.ConnState = stats.trackConn
+	ts.Start()
+	defer ts.Close()
+
+	client := ts.Client()
+	for i := range 4 {
+		resp, err := client.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if opened := stats.connsOpened.Load(); opened != 1 {
+		t.Fatalf("%d connections opened, want the 4 requests to share 1", opened)
+	}
+	if got := stats.reuseRatio(); got != 0.75 {
+		t.Errorf("reuse ratio = %g, want 0.75", got)
+	}
+}
+
+func TestMetricsNegotiatesOpenMetrics(t *testing.T) {
+	captureLogs(t)
+	h := newHandler(newTestServer(t))
+
+	om := serve(h, "GET", "/metrics", nil, "Accept", "application/openmetrics-text; version=1.0.0")
+	if ct := om.Header().Get("Content-Type"); ct != openMetricsContentType {
+		t.Errorf("OpenMetrics Content-Type = %q, want %q", ct, openMetricsContentType)
+	}
+	if !strings.HasSuffix(om.Body.String(), "\n# EOF\n") {
+		t.Errorf("OpenMetrics body does not end with # EOF:\n%s", om.Body)
+	}
+	if !strings.Contains(om.Body.String(), "# TYPE http_requests_completed counter\n") {
+		t.Errorf("OpenMetrics counter family keeps its _total suffix:\n%s", om.Body)
+	}
+
+	prom := serve(h, "GET", "/metrics", nil)
+	if ct := prom.Header().Get("Content-Type"); ct != prometheusContentType || strings.Contains(prom.Body.String(), "# EOF") {
+		t.Errorf("default exposition: Content-Type %q, body:\n%s", ct, prom.Body)
+	}
+	if prom.Header().Get("Vary") != "Accept" {
+		t.Error("exposition does not vary on Accept")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+)
+
+// Queries the handlers run repeatedly. Warm-up prepares them up front when
+// warmUpPrepare is set; anything else is prepared on first use.
+const (
+	queryMigrationCount = "SELECT COUNT(*) FROM schema_migrations"
+)
+
+var preparedQueries = []string{queryMigrationCount}
+
+// warmUpPrepare controls whether warm-up fills the statement cache.
+var warmUpPrepare = true
+
+// stmtCache keeps one prepared statement per query string so hot queries skip
+// re-parsing. A *sql.Stmt is safe for concurrent use and re-prepares itself on
+// whichever pool connection runs it, so one per query is enough.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// get returns the cached statement for query, preparing it on a miss. The
+// lock is held across Prepare so concurrent misses prepare only once.
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.stmts[query]; ok {
+		stats.stmtHits.Add(1)
+		return st, nil
+	}
+	stats.stmtMisses.Add(1)
+	st, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[string]*sql.Stmt)
+	}
+	c.stmts[query] = st
+	return st, nil
+}
+
+// warm prepares every query in queries and returns how many are now cached.
+// A query that fails to prepare, say because its table doesn't exist yet, is
+// logged and left to get.
+func (c *stmtCache) warm(ctx context.Context, db *sql.DB, queries []string) int {
+	n := 0
+	for _, q := range queries {
+		if _, err := c.get(ctx, db, q); err != nil {
+			log.Printf("level=warn msg=\"prepare failed\" query=%q err=%v", q, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// close closes and forgets every cached statement.
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for q, st := range c.stmts {
+		if err := st.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(c.stmts, q)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStatementCacheReusesAndCloses(t *testing.T) {
+	captureLogs(t)
+	zeroForTest(t, &stats.stmtHits, &stats.stmtMisses)
+	s := newTestServer(t)
+	if n := stats.stmtMisses.Load(); n != int64(len(preparedQueries)) {
+		t.Fatalf("warm-up prepared %d statements, want %d", n, len(preparedQueries))
+	}
+
+	first, err := s.stmts.get(t.Context(), s.db, queryMigrationCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		if err := s.checkMigrations(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, _ := s.stmts.get(t.Context(), s.db, queryMigrationCount); st != first {
+		t.Error("repeated query got a different statement")
+	}
+	if hits, misses := stats.stmtHits.Load(), stats.stmtMisses.Load(); hits != 7 || misses != 1 {
+		t.Errorf("hits=%d misses=%d, want 7 and 1", hits, misses)
+	}
+	var body struct {
+		Cache struct{ Hits, Misses int64 } `json:"statement_cache"`
+	}
+	if err := json.Unmarshal(serve(newHandler(s), "GET", "/stats", nil).Body.Bytes(), &body); err != nil || body.Cache.Hits != 7 || body.Cache.Misses != 1 {
+		t.Errorf("/stats statement_cache = %+v %v, want 7 hits 1 miss", body.Cache, err)
+	}
+
+	s.runShutdownHooks(t.Context())
+	if len(s.stmts.stmts) != 0 {
+		t.Errorf("%d statements still cached after shutdown", len(s.stmts.stmts))
+	}
+	var n int
+	if err := first.QueryRow().Scan(&n); err == nil || err.Error() != "sql: statement is closed" {
+		t.Errorf("query on a statement after shutdown: %v, want it closed", err)
+	}
+}
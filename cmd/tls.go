@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TLS serving is enabled by setting both tlsCert and tlsKey.
+var (
+	tlsCert       string
+	tlsKey        string
+	tlsMinVersion = "1.2"
+	tlsCiphers    string
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the server's TLS baseline from the -tls-* flags. TLS
+// 1.0 and 1.1, and cipher suites crypto/tls lists as insecure, are rejected
+// rather than quietly allowed. Cipher suites only constrain TLS 1.2: TLS 1.3
+// suites are fixed by crypto/tls, so naming any with a 1.3 minimum is an
+// error too.
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[tlsMinVersion]
+	if !ok {
+		if tlsMinVersion == "1.0" || tlsMinVersion == "1.1" {
+			return nil, fmt.Errorf("TLS %s is insecure; -tls-min-version must be 1.2 or 1.3", tlsMinVersion)
+		}
+		return nil, fmt.Errorf("unknown TLS version %q; want 1.2 or 1.3", tlsMinVersion)
+	}
+	cfg := &tls.Config{MinVersion: minVersion}
+
+	names := splitList(tlsCiphers)
+	if len(names) == 0 {
+		return cfg, nil
+	}
+	if minVersion == tls.VersionTLS13 {
+		return nil, fmt.Errorf("-tls-ciphers has no effect with -tls-min-version=1.3")
+	}
+	for _, name := range names {
+		if suiteByName(tls.InsecureCipherSuites(), name) != nil {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		s := suiteByName(tls.CipherSuites(), name)
+		if s == nil {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if !slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only and can't be configured", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, s.ID)
+	}
+	return cfg, nil
+}
+
+func suiteByName(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, s := range suites {
+		if strings.EqualFold(s.Name, name) {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTLSMinVersionRefusesOlderClients(t *testing.T) {
+	captureLogs(t)
+	for _, tc := range []struct {
+		min     string
+		refused uint16
+		ok      uint16
+	}{
+		{"1.2", tls.VersionTLS11, tls.VersionTLS12},
+		{"1.3", tls.VersionTLS12, tls.VersionTLS13},
+	} {
+		setForTest(t, &tlsMinVersion, tc.min)
+		cfg, err := newTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewUnstartedServer(newHandler(newTestServer(t)))
+		ts.TLS = cfg
+		ts.StartTLS()
+		dial := func(v uint16) error {
+			conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: v})
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+		if err := dial(tc.refused); err == nil || !strings.Contains(err.Error(), "protocol version") {
+			t.Errorf("min %s: %s handshake err = %v, want a protocol version alert", tc.min, tls.VersionName(tc.refused), err)
+		}
+		if err := dial(tc.ok); err != nil {
+			t.Errorf("min %s: %s handshake failed: %v", tc.min, tls.VersionName(tc.ok), err)
+		}
+		ts.Close()
+	}
+}
+
+func TestInsecureTLSConfigIsRejected(t *testing.T) {
+	for _, tc := range []struct{ min, ciphers, wantErr string }{
+		{"1.0", "", "TLS 1.0 is insecure"},
+		{"1.1", "", "TLS 1.1 is insecure"},
+		{"2", "", `unknown TLS version "2"`},
+		{"1.2", "TLS_RSA_WITH_RC4_128_SHA", "is insecure"},
+		{"1.2", "TLS_NOPE", "unknown cipher suite"},
+		{"1.2", "TLS_AES_128_GCM_SHA256", "TLS 1.3 only"},
+		{"1.3", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "no effect"},
+	} {
+		setForTest(t, &tlsMinVersion, tc.min)
+		setForTest(t, &tlsCiphers, tc.ciphers)
+		if _, err := newTLSConfig(); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("-tls-min-version=%s -tls-ciphers=%q: err = %v, want %q", tc.min, tc.ciphers, err, tc.wantErr)
+		}
+	}
+	setForTest(t, &tlsMinVersion, "1.2")
+	setForTest(t, &tlsCiphers, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if cfg, err := newTLSConfig(); err != nil || len(cfg.CipherSuites) != 1 || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("valid config = %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// warmUpRetryDelay is how long to wait between failed warm-up attempts.
+const warmUpRetryDelay = 2 * time.Second
+
+// warmUpMigrate controls whether warm-up applies pending schema migrations.
+var warmUpMigrate = true
+
+// warmUp pings the DB and, if enabled, applies pending migrations and
+// prepares hot statements so the first real request doesn't pay for them.
+func (s *server) warmUp(ctx context.Context) error {
+	if err := s.warmUpDB(ctx); err != nil {
+		return err
+	}
+	if warmUpPrepare {
+		s.stmts.warm(ctx, s.db, preparedQueries)
+	}
+	return nil
+}
+
+// warmUpDB is the part of warmUp before statements are prepared: the ping
+// and, if enabled, the migrations.
+func (s *server) warmUpDB(ctx context.Context) error {
+	if s.db == nil {
+		return errDBUnavailable
+	}
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	if warmUpMigrate && !dbReadOnly {
+		if _, err := applyMigrations(ctx, s.db, migrations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmUpLoop retries warmUp until it succeeds, then marks s ready. Drift is
+// not retried: the schema won't fix itself, so s stays not-ready and records
+// the error for /readyz to report.
+func (s *server) warmUpLoop(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := s.warmUp(ctx)
+		if err == nil {
+			s.ready.Store(true)
+			log.Printf("level=info msg=\"warm-up complete\" attempt=%d duration=%s", attempt, time.Since(start))
+			return
+		}
+		if errors.Is(err, errMigrationDrift) {
+			s.drift.Store(&err)
+			log.Printf("level=error msg=\"warm-up failed, staying not ready\" attempt=%d err=%v", attempt, err)
+			return
+		}
+		log.Printf("level=error msg=\"warm-up failed\" attempt=%d duration=%s err=%v retry_in=%s", attempt, time.Since(start), err, warmUpRetryDelay)
+		select {
+		case <-time.After(warmUpRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// primePool opens every connection the pool allows and runs SELECT 1 on each,
+// so later requests find warm idle connections. It returns how many it primed.
+func (s *server) primePool(ctx context.Context) (int, error) {
+	if s.db == nil {
+		return 0, errDBUnavailable
+	}
+	n := s.db.Stats().MaxOpenConnections
+	if n <= 0 {
+		n = dbPoolSize
+	}
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for range n {
+		c, err := s.db.Conn(ctx)
+		if err != nil {
+			return len(conns), err
+		}
+		conns = append(conns, c)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(conns))
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.ExecContext(ctx, "SELECT 1")
+		}()
+	}
+	wg.Wait()
+	return len(conns), errors.Join(errs...)
+}
+
+// warmupHandler runs warm-up on demand and primes the connection pool,
+// reporting what it warmed and how long each step took. It is safe to call
+// repeatedly.
+func (s *server) warmupHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	warmed := make(map[string]any)
+
+	if err := s.warmUpDB(r.Context()); err != nil {
+		respondError(w, r, http.StatusInternalServerError, "warmup_failed", "warm-up failed", err, nil)
+		return
+	}
+	warmed["db_ping"] = "ok"
+	if warmUpMigrate && !dbReadOnly {
+		warmed["migrations"] = "ok"
+	}
+	if warmUpPrepare {
+		stmtStart := time.Now()
+		n := s.stmts.warm(r.Context(), s.db, preparedQueries)
+		warmed["statements"] = map[string]any{"prepared": n, "duration": time.Since(stmtStart).String()}
+	}
+	s.ready.Store(true)
+
+	poolStart := time.Now()
+	n, err := s.primePool(r.Context())
+	if err != nil {
+		respondError(w, r, http.StatusInternalServerError, "prime_pool_failed", "priming pool failed", err, nil)
+		return
+	}
+	addLogField(r.Context(), "pool_conns", n)
+	warmed["db_pool"] = map[string]any{"connections": n, "duration": time.Since(poolStart).String()}
+
+	log.Printf("level=info msg=\"warm-up requested\" pool_connections=%d duration=%s", n, time.Since(start))
+	respondJSON(w, r, http.StatusOK, map[string]any{"warmed": warmed, "duration": time.Since(start).String()})
+}
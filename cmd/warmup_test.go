@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadyOnlyAfterWarmUp(t *testing.T) {
+	captureLogs(t)
+	db, err := openDB(memoryDSN("ready-after-warmup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newServer(db)
+	h := newHandler(s)
+
+	if rec := serve(h, "GET", "/readyz", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("before warm-up: /readyz = %d, want 503", rec.Code)
+	}
+	s.warmUpLoop(t.Context())
+	if rec := serve(h, "GET", "/readyz", nil); rec.Code != http.StatusOK {
+		t.Fatalf("after warm-up: /readyz = %d %q, want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestMigrationDriftIsReportedOnReadyz(t *testing.T) {
+	logs := captureLogs(t)
+	s := newTestServer(t)
+	if _, err := s.db.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	s.ready.Store(false)
+	s.warmUpLoop(t.Context())
+
+	rec := serve(newHandler(s), "GET", "/readyz", nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "migration drift") {
+		t.Errorf("/readyz = %d %q, want 503 naming the drift", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logs.String(), `msg="warm-up failed, staying not ready"`) {
+		t.Errorf("drift was not logged:\n%s", logs)
+	}
+}
+
+func TestDegradedStartWithoutDB(t *testing.T) {
+	captureLogs(t)
+	if _, err := openDB("file:" + t.TempDir() + "/missing/demo.db?mode=ro"); err == nil {
+		t.Fatal("openDB succeeded on a missing file")
+	}
+	// This is what main runs with once -startup-errors=continue gets past
+	// the failed open.
+	h := newHandler(newServer(nil))
+	for _, c := range []struct {
+		target string
+		want   int
+	}{
+		{"/livez", http.StatusOK},
+		{"/readyz", http.StatusServiceUnavailable},
+		{"/migrate", http.StatusServiceUnavailable},
+		{"/", http.StatusOK},
+	} {
+		if rec := serve(h, "GET", c.target, nil); rec.Code != c.want {
+			t.Errorf("%s = %d %q, want %d", c.target, rec.Code, rec.Body, c.want)
+		}
+	}
+}
+
+func TestWarmupEndpointPrimesThePool(t *testing.T) {
+	captureLogs(t)
+	setForTest(t, &adminToken, "secret")
+	s := newTestServer(t)
+	h := newHandler(s)
+
+	if rec := serve(h, "POST", "/warmup", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("/warmup without a token = %d, want 401", rec.Code)
+	}
+	rec := serve(h, "POST", "/warmup", nil, "Authorization", "Bearer secret")
+	var body struct {
+		Warmed struct {
+			DBPing     string `json:"db_ping"`
+			Migrations string `json:"migrations"`
+			DBPool     struct {
+				Connections int `json:"connections"`
+			} `json:"db_pool"`
+			Statements struct {
+				Prepared int    `json:"prepared"`
+				Duration string `json:"duration"`
+			} `json:"statements"`
+		} `json:"warmed"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if body.Warmed.DBPing != "ok" || body.Warmed.Migrations != "ok" || body.Warmed.DBPool.Connections != dbPoolSize {
+		t.Errorf("warmed = %+v, want ping, migrations and %d pool connections", body.Warmed, dbPoolSize)
+	}
+	if st := body.Warmed.Statements; st.Prepared != len(preparedQueries) || st.Duration == "" {
+		t.Errorf("warmed statements = %+v, want %d prepared with a duration", st, len(preparedQueries))
+	}
+	if n := len(s.stmts.stmts); n != len(preparedQueries) {
+		t.Errorf("%d statements cached, want %d", n, len(preparedQueries))
+	}
+	// Every connection is open and idle, so the next queries dial nothing.
+	if st := s.db.Stats(); st.Idle != dbPoolSize {
+		t.Errorf("idle connections = %d, want %d", st.Idle, dbPoolSize)
+	}
+	opened := s.db.Stats().OpenConnections
+	for range dbPoolSize {
+		if err := s.db.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.db.Stats(); st.OpenConnections != opened || st.WaitCount != 0 {
+		t.Errorf("queries after warm-up opened connections or waited: %+v", st)
+	}
+}
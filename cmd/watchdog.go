@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// handlerHardLimit is how long a handler may run before watchdogMiddleware
+// reports it; 0 disables the watchdog. It should sit well above the request
+// timeouts, since it exists to catch handlers that ignore them.
+var handlerHardLimit time.Duration
+
+// watchdogMiddleware logs, with the handler goroutine's stack, any request
+// still being handled after handlerHardLimit. The response timeout only
+// cancels the context; a handler that never looks at ctx.Done() keeps
+// running, and this is how it shows up. The request is left alone.
+func watchdogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handlerHardLimit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		id := goroutineID()
+		t := time.AfterFunc(handlerHardLimit, func() {
+			log.Printf("level=error msg=\"handler exceeded hard limit\" method=%s path=%s limit=%s elapsed=%s ctx_err=%v goroutine=%d stack=%q",
+				r.Method, r.URL.Path, handlerHardLimit, time.Since(start).Round(time.Millisecond), r.Context().Err(), id, goroutineStack(id))
+		})
+		defer t.Stop()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goroutineID parses the calling goroutine's ID out of its stack header,
+// "goroutine 123 [running]:". The runtime offers no API for it; the ID is
+// only used to find the goroutine again in a full dump.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// goroutineStack returns the stack of goroutine id from a dump of all
+// goroutines, or "" if it has exited.
+func goroutineStack(id uint64) string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	prefix := []byte("goroutine " + strconv.FormatUint(id, 10) + " [")
+	for g := range bytes.SplitSeq(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(g, prefix) {
+			return string(bytes.TrimSpace(g))
+		}
+	}
+	return ""
+}
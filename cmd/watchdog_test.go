@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogReportsStuckHandler(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &handlerHardLimit, 20*time.Millisecond)
+	// The handler ignores its context, as the watchdog's targets do.
+	h := watchdogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+	}))
+	serve(h, "GET", "/stuck", nil)
+
+	line := logLine(logs.String(), `msg="handler exceeded hard limit"`)
+	if line == "" {
+		t.Fatalf("no hard-limit report:\n%s", logs)
+	}
+	for _, want := range []string{"path=/stuck", "limit=20ms", "TestWatchdogReportsStuckHandler"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("report lacks %q: %s", want, line)
+		}
+	}
+}
+
+func TestWatchdogIgnoresFastHandler(t *testing.T) {
+	logs := captureLogs(t)
+	setForTest(t, &handlerHardLimit, 20*time.Millisecond)
+	serve(watchdogMiddleware(http.HandlerFunc(livezHandler)), "GET", "/livez", nil)
+	time.Sleep(40 * time.Millisecond)
+	if strings.Contains(logs.String(), "hard limit") {
+		t.Errorf("fast handler was reported:\n%s", logs)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+// goWorker runs fn in a background goroutine tracked by s. fn must return
+// once ctx is cancelled; stopWorkers cancels it during shutdown and waits for
+// every worker before the process exits.
+func (s *server) goWorker(name string, fn func(ctx context.Context)) {
+	s.workersMu.Lock()
+	s.running[name]++
+	s.workersMu.Unlock()
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		start := time.Now()
+		fn(s.workerCtx)
+		s.workersMu.Lock()
+		if s.running[name]--; s.running[name] == 0 {
+			delete(s.running, name)
+		}
+		s.workersMu.Unlock()
+		log.Printf("level=info msg=\"worker exited\" worker=%s uptime=%s", name, time.Since(start))
+	}()
+}
+
+// stopWorkers cancels the workers' context and waits for them to return,
+// giving up when ctx ends and naming the workers still running.
+func (s *server) stopWorkers(ctx context.Context) {
+	s.cancelWorkers()
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("level=info msg=\"all workers exited\"")
+	case <-ctx.Done():
+		s.workersMu.Lock()
+		names := slices.Sorted(maps.Keys(s.running))
+		s.workersMu.Unlock()
+		log.Printf("level=error msg=\"workers did not exit in time\" workers=%q", names)
+	}
+}
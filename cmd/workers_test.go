@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// idleWorker waits for its context like a well-behaved worker.
+func idleWorker(ctx context.Context) { <-ctx.Done() }
+
+func TestWorkersExitCleanlyOnShutdown(t *testing.T) {
+	logs := captureLogs(t)
+	s := newServer(nil)
+	for _, name := range []string{"one", "two", "two"} {
+		s.goWorker(name, idleWorker)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	s.stopWorkers(ctx)
+
+	out := logs.String()
+	if strings.Count(out, `msg="worker exited" worker=one`) != 1 || strings.Count(out, `msg="worker exited" worker=two`) != 2 {
+		t.Errorf("not every worker reported its exit:\n%s", out)
+	}
+	if !strings.Contains(out, `msg="all workers exited"`) || len(s.running) != 0 {
+		t.Errorf("running = %v after shutdown:\n%s", s.running, out)
+	}
+}
+
+func TestStuckWorkerIsNamed(t *testing.T) {
+	logs := captureLogs(t)
+	s := newServer(nil)
+	release := make(chan struct{})
+	defer close(release)
+	s.goWorker("fine", idleWorker)
+	s.goWorker("stuck", func(context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	s.stopWorkers(ctx)
+	if !strings.Contains(logs.String(), `msg="workers did not exit in time" workers=["stuck"]`) {
+		t.Errorf("stuck worker not named:\n%s", logs)
+	}
+}